@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loadBaseline reads the --compare-baseline file, a JSON object of the
+// expected duration of phases, e.g. {"dns": "20ms", "ttfb": "150ms"}.
+func loadBaseline(path string) (map[string]time.Duration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := append(phaseNames(), "total")
+	baseline := make(map[string]time.Duration, len(raw))
+	for phase, value := range raw {
+		if !slices.Contains(names, phase) {
+			return nil, fmt.Errorf("%s: unknown phase %q, must be one of %s", path, phase, strings.Join(names, ", "))
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: invalid duration of %s: %q", path, phase, value)
+		}
+		baseline[phase] = d
+	}
+	if len(baseline) == 0 {
+		return nil, fmt.Errorf("%s: no phase in the baseline", path)
+	}
+	return baseline, nil
+}
+
+// compareBaseline adds a Baseline stage comparing the phases of result with
+// the baseline, and warns about those over --baseline-multiple times their
+// baseline. Phases the request didn't go through, such as connect on a
+// reused connection, aren't compared.
+func (r *Runner) compareBaseline(logger *logrus.Logger, result *RequestResult) {
+	phases := map[string]interface{}{}
+	var anomalies []string
+	for _, name := range append(phaseNames(), "total") {
+		base, ok := r.baseline[name]
+		d, measured := result.Durations[name]
+		if !ok || !measured {
+			continue
+		}
+		ratio := float64(d) / float64(base)
+		anomalous := ratio > r.cfg.BaselineMultiple
+		phases[name] = map[string]interface{}{
+			"baseline":  base.String(),
+			"measured":  d.String(),
+			"ratio":     ratio,
+			"anomalous": anomalous,
+		}
+		if anomalous {
+			anomalies = append(anomalies, name)
+		}
+	}
+	result.Stages = append(result.Stages, newStage("Baseline", map[string]interface{}{
+		"multiple":  r.cfg.BaselineMultiple,
+		"phases":    phases,
+		"anomalies": anomalies,
+	}))
+	if len(anomalies) > 0 {
+		logger.WithFields(logrus.Fields{
+			"anomalies": anomalies,
+			"multiple":  r.cfg.BaselineMultiple,
+			"phases":    phases,
+		}).Warn("Phases deviated from the baseline")
+	}
+}
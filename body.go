@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+)
+
+var sensitiveBodyPattern = regexp.MustCompile(`(?i)("?(?:password|passwd|secret|token|access_token|refresh_token|id_token|api_key|apikey|authorization)"?\s*[:=]\s*"?)([^"&,\s}]+)`)
+
+func redactBody(body []byte) []byte {
+	return sensitiveBodyPattern.ReplaceAll(body, []byte("${1}[REDACTED]"))
+}
+
+// captureBody reads at most limit bytes of the body for the trace and drains
+// the rest so the connection can go back to the pool, up to maxSize bytes in
+// all when maxSize > 0.
+func captureBody(resp *http.Response, limit, maxSize int64) map[string]interface{} {
+	hash := sha256.New()
+	body := io.TeeReader(resp.Body, hash)
+
+	var buf bytes.Buffer
+	captured, err := io.Copy(&buf, io.LimitReader(body, limit))
+	var rest int64
+	exceeded := false
+	if err == nil {
+		remaining := int64(-1)
+		if maxSize > 0 {
+			remaining = max(maxSize-captured, 0)
+		}
+		rest, exceeded, err = drainBody(body, remaining)
+	}
+
+	values := map[string]interface{}{
+		"status":      resp.StatusCode,
+		"contentType": resp.Header.Get("Content-Type"),
+		"size":        captured + rest,
+		"captured":    captured,
+		"truncated":   rest > 0,
+		"sha256":      hex.EncodeToString(hash.Sum(nil)),
+	}
+	if err != nil {
+		values["error"] = err.Error()
+	}
+	if exceeded {
+		values["maxResponseSizeExceeded"] = true
+	}
+	if utf8.Valid(buf.Bytes()) {
+		values["body"] = string(redactBody(buf.Bytes()))
+	} else {
+		values["bodyBase64"] = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+
+	return values
+}
+
+// drainBody reads body to the end, or only up to maxSize bytes unless it's
+// negative, reporting whether it stopped because there was more.
+func drainBody(body io.Reader, maxSize int64) (int64, bool, error) {
+	if maxSize < 0 {
+		n, err := io.Copy(io.Discard, body)
+		return n, false, err
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(body, maxSize+1))
+	if n > maxSize {
+		return maxSize, true, err
+	}
+	return n, false, err
+}
+
+// expectBodyLimit caps the body --expect-sha256 reads.
+const expectBodyLimit = 256 << 20
+
+// bodySHA256 drains the body and returns its SHA-256, failing when it is
+// larger than expectBodyLimit.
+func bodySHA256(body io.Reader) ([]byte, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, io.LimitReader(body, expectBodyLimit+1))
+	if err != nil {
+		return nil, size, err
+	}
+	if size > expectBodyLimit {
+		return nil, size, fmt.Errorf("body larger than %d bytes", expectBodyLimit)
+	}
+	return hash.Sum(nil), size, nil
+}
+
+// checkBodySHA256 fails the request when the body doesn't hash to expected,
+// recording both hashes in a BodyHashMismatch stage.
+func checkBodySHA256(result *RequestResult, trace *BufferedClientTrace, expected, actual []byte, size int64, err error) {
+	if err == nil && bytes.Equal(expected, actual) {
+		return
+	}
+
+	values := map[string]interface{}{
+		"expected": hex.EncodeToString(expected),
+		"size":     size,
+	}
+	if err != nil {
+		values["error"] = err.Error()
+		result.Error = fmt.Sprintf("checking the response body sha256: %v", err)
+	} else {
+		values["actual"] = hex.EncodeToString(actual)
+		result.Error = fmt.Sprintf("response body sha256 mismatch: expected %x, got %x", expected, actual)
+	}
+	result.ErrorCategory = "body_mismatch"
+	trace.add("BodyHashMismatch", values)
+}
+
+// maxBodySize caps the body --body-size keeps in memory.
+const maxBodySize = 1 << 30
+
+// bodyFill is the content of the body generated with --body-size: zero or
+// random bytes.
+type bodyFill string
+
+func (f *bodyFill) String() string {
+	return string(*f)
+}
+
+func (f *bodyFill) Set(value string) error {
+	if value != "zero" && value != "random" {
+		return fmt.Errorf("invalid body fill %q, must be zero or random", value)
+	}
+	*f = bodyFill(value)
+	return nil
+}
+
+// generateBody returns a body of size bytes of fill. It's generated once and
+// sent by every request, random bodies included.
+func generateBody(size int64, fill bodyFill) (string, error) {
+	if size > maxBodySize {
+		return "", fmt.Errorf("body of %d bytes larger than %d", size, maxBodySize)
+	}
+	b := make([]byte, size)
+	if fill == "random" {
+		random.Read(b)
+	}
+	return string(b), nil
+}
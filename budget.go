@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// phaseBudgets is the longest every phase of --phase-budget may take, given
+// as phase=duration pairs.
+type phaseBudgets map[string]time.Duration
+
+func (b *phaseBudgets) String() string {
+	pairs := make([]string, 0, len(*b))
+	for phase, budget := range *b {
+		pairs = append(pairs, phase+"="+budget.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (b *phaseBudgets) Set(value string) error {
+	budgets := phaseBudgets{}
+	for _, pair := range strings.Split(value, ",") {
+		phase, d, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !slices.Contains(phaseNames(), phase) {
+			return fmt.Errorf("invalid phase budget %q, want phase=duration with phase one of %s", pair, strings.Join(phaseNames(), ", "))
+		}
+		budget, err := time.ParseDuration(d)
+		if err != nil || budget <= 0 {
+			return fmt.Errorf("invalid budget of %s: %q", phase, d)
+		}
+		budgets[phase] = budget
+	}
+	*b = budgets
+	return nil
+}
+
+type budgetExceededError struct {
+	phase  string
+	budget time.Duration
+}
+
+func (e *budgetExceededError) Error() string {
+	return fmt.Sprintf("%s phase exceeded its budget of %s", e.phase, e.budget)
+}
+
+// budgetEnforcer cancels a request once a phase runs over its budget. It
+// follows the phases through the stages of the trace.
+type budgetEnforcer struct {
+	budgets phaseBudgets
+	trace   *BufferedClientTrace
+	cancel  context.CancelCauseFunc
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newBudgetEnforcer(budgets phaseBudgets, trace *BufferedClientTrace, cancel context.CancelCauseFunc) *budgetEnforcer {
+	return &budgetEnforcer{
+		budgets: budgets,
+		trace:   trace,
+		cancel:  cancel,
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+// stage starts the timer of the phase that name starts and stops the one of
+// the phase it ends. Only the first start of a phase counts.
+func (e *budgetEnforcer) stage(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, phase := range phases {
+		budget, ok := e.budgets[phase.Name]
+		if !ok {
+			continue
+		}
+		switch name {
+		case phase.Start:
+			if _, started := e.timers[phase.Name]; !started {
+				e.timers[phase.Name] = time.AfterFunc(budget, func() {
+					e.exceeded(phase.Name, budget)
+				})
+			}
+		case phase.End:
+			if timer, started := e.timers[phase.Name]; started {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (e *budgetEnforcer) exceeded(phase string, budget time.Duration) {
+	e.trace.add("PhaseBudgetExceeded", map[string]interface{}{
+		"phase":  phase,
+		"budget": budget.String(),
+	})
+	e.cancel(&budgetExceededError{phase: phase, budget: budget})
+}
+
+func (e *budgetEnforcer) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, timer := range e.timers {
+		timer.Stop()
+	}
+}
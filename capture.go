@@ -0,0 +1,58 @@
+package main
+
+// addCaptureStages adds what the capture tells about the connection of the
+// request to result and to each of its attempts: a TCPReset stage, a
+// PossibleMTUIssue stage and, with --tcp-rtt, the round trip of the TCP
+// handshake.
+func addCaptureStages(result *RequestResult, capture string, cfg *Config) error {
+	report, err := readPcap(capture)
+	if err != nil {
+		return err
+	}
+	for _, res := range append([]*RequestResult{result}, result.Attempts...) {
+		added := addTCPReset(res, report)
+		if addMTUIssue(res, report) {
+			added = true
+		}
+		if added && cfg.RelativeTime {
+			setRelativeTimes(res.Stages)
+		}
+		if cfg.TCPRTT {
+			addHandshakeRTT(res, report)
+		}
+	}
+	return nil
+}
+
+// addHandshakeRTT adds the round trip of the TCP handshake on the wire, from
+// the SYN to the SYN-ACK, to the ConnectDone stage of result next to the
+// connect time of the dialer. The difference is spent in the network stack
+// of the client rather than on the network.
+func addHandshakeRTT(result *RequestResult, report *pcapReport) {
+	conn := requestConn(result.Stages, report)
+	if conn == nil {
+		return
+	}
+	syn, ok := findStage(conn.stages, "ConnectStart")
+	if !ok {
+		return
+	}
+	synAck, ok := findStage(conn.stages, "ConnectDone")
+	if !ok {
+		return
+	}
+	rtt := synAck.Time.Sub(syn.Time)
+
+	for i, stage := range result.Stages {
+		if stage.Name != "ConnectDone" || stage.Values["addr"] != conn.server {
+			continue
+		}
+		stage.Values["wireRTT"] = rtt.String()
+		if connect, ok := result.Durations["connect"]; ok {
+			stage.Values["connect"] = connect.String()
+			stage.Values["stackDelay"] = (connect - rtt).String()
+		}
+		result.Stages[i] = stage
+		return
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+)
+
+type chromeEvent struct {
+	Name  string                 `json:"name"`
+	Cat   string                 `json:"cat"`
+	Phase string                 `json:"ph"`
+	TS    float64                `json:"ts"`
+	Dur   float64                `json:"dur,omitempty"`
+	PID   int                    `json:"pid"`
+	TID   int                    `json:"tid"`
+	Scope string                 `json:"s,omitempty"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// ChromeExporter writes every request to the <run>-trace.json file of
+// --filename-template, or <run>-stepN-trace.json for a step of --sequence,
+// in the Chrome trace event format, for chrome://tracing or Perfetto.
+type ChromeExporter struct {
+	filePath func(suffix string) (string, error)
+}
+
+func chromeTimestamp(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Microsecond)
+}
+
+func (e *ChromeExporter) Export(runID string, result *RequestResult) error {
+	events := make([]chromeEvent, 0, len(result.Stages)+len(phases)+1)
+	for _, span := range phaseSpans(result.Stages) {
+		tid := 2
+		if span.Name == "total" {
+			tid = 1
+		}
+		events = append(events, chromeEvent{
+			Name:  span.Name,
+			Cat:   "phase",
+			Phase: "X",
+			TS:    chromeTimestamp(span.Start),
+			Dur:   float64(span.Duration()) / float64(time.Microsecond),
+			PID:   1,
+			TID:   tid,
+		})
+	}
+	for _, stage := range result.Stages {
+		events = append(events, chromeEvent{
+			Name:  stage.Name,
+			Cat:   "stage",
+			Phase: "i",
+			TS:    chromeTimestamp(stage.Time),
+			PID:   1,
+			TID:   3,
+			Scope: "t",
+			Args:  stage.Values,
+		})
+	}
+
+	path, err := e.filePath(stepSuffix(result, "-trace.json"))
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(path, map[string]interface{}{
+		"traceEvents":     events,
+		"displayTimeUnit": "ms",
+		"otherData": map[string]interface{}{
+			"runID":  runID,
+			"url":    result.URL,
+			"status": result.Status,
+			"error":  result.Error,
+		},
+	})
+}
+
+func (e *ChromeExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type runRecord struct {
+	Error  string  `json:"error"`
+	Status int     `json:"status"`
+	Stages []Stage `json:"stages"`
+}
+
+// loadRun reads a run log written with fieldMap and returns the last entry
+// that carries stages.
+func loadRun(path string, fieldMap logrus.FieldMap) (*runRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var run *runRecord
+	err = decodeEntries(f, func(_ int, raw json.RawMessage) {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return
+		}
+		b, err := json.Marshal(canonicalEntry(obj, fieldMap))
+		if err != nil {
+			return
+		}
+		var record runRecord
+		if err := json.Unmarshal(b, &record); err != nil {
+			return
+		}
+		if record.Stages != nil {
+			run = &record
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if run == nil {
+		return nil, fmt.Errorf("%s: no stages found", path)
+	}
+
+	return run, nil
+}
+
+func formatDuration(d time.Duration, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+func compareRuns(w io.Writer, before, after *runRecord) {
+	beforeDurations := phaseDurations(before.Stages)
+	afterDurations := phaseDurations(after.Stages)
+
+	worst := ""
+	var worstDelta time.Duration
+
+	fmt.Fprintf(w, "%-8s %12s %12s %12s\n", "phase", "before", "after", "delta")
+	for _, name := range append(phaseNames(), "total") {
+		b, bok := beforeDurations[name]
+		a, aok := afterDurations[name]
+		if !bok && !aok {
+			continue
+		}
+
+		delta := "-"
+		if bok && aok {
+			d := a - b
+			delta = formatDuration(d, true)
+			if d > 0 {
+				delta = "+" + delta
+			}
+			if name != "total" && d > worstDelta {
+				worst, worstDelta = name, d
+			}
+		}
+		fmt.Fprintf(w, "%-8s %12s %12s %12s\n", name, formatDuration(b, bok), formatDuration(a, aok), delta)
+	}
+
+	if before.Status != after.Status {
+		fmt.Fprintf(w, "status: %d -> %d\n", before.Status, after.Status)
+	}
+	if before.Error != after.Error {
+		fmt.Fprintf(w, "error: %q -> %q\n", before.Error, after.Error)
+	}
+	if worst != "" {
+		fmt.Fprintf(w, "slowest change: %s went from %s to %s\n", worst,
+			formatDuration(beforeDurations[worst], true), formatDuration(afterDurations[worst], true))
+	}
+}
+
+func phaseNames() []string {
+	names := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		names = append(names, phase.Name)
+	}
+	return names
+}
+
+func compareMain(args []string) int {
+	var cfg Config
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	logFieldFlags(fs, &cfg)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		fmt.Println("Usage: go run . compare [--json-log-*-field-name NAME]... <before.log> <after.log>")
+		return exitUsage
+	}
+
+	before, err := loadRun(fs.Arg(0), logFieldMap(&cfg))
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	after, err := loadRun(fs.Arg(1), logFieldMap(&cfg))
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+
+	compareRuns(os.Stdout, before, after)
+	return 0
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFlagSet registers a few flags of each kind on a flag set of their
+// own, as parseConfig does on the command line.
+func newTestFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("dump-pcap", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&cfg.Count, "count", 0, "")
+	fs.DurationVar(&cfg.Interval, "interval", 0, "")
+	fs.StringVar(&cfg.HostHeader, "host-header", "default.example", "")
+	fs.Var(&cfg.Headers, "H", "")
+	fs.StringVar(&cfg.EnvPrefix, "env-prefix", "DUMPPCAP_", "")
+	fs.StringVar(&cfg.ConfigFile, "config", "", "")
+	return fs
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResolveConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		// fileInEnv names the config file with DUMPPCAP_CONFIG instead of
+		// --config.
+		fileInEnv  bool
+		count      int
+		interval   time.Duration
+		hostHeader string
+	}{
+		{
+			name:       "defaults",
+			hostHeader: "default.example",
+		},
+		{
+			name:       "config file over defaults",
+			file:       `{"count": 3, "interval": "2s", "host-header": "file.example"}`,
+			count:      3,
+			interval:   2 * time.Second,
+			hostHeader: "file.example",
+		},
+		{
+			name:       "environment over config file",
+			env:        map[string]string{"DUMPPCAP_COUNT": "5", "DUMPPCAP_HOST_HEADER": "env.example"},
+			file:       `{"count": 3, "interval": "2s", "host-header": "file.example"}`,
+			count:      5,
+			interval:   2 * time.Second,
+			hostHeader: "env.example",
+		},
+		{
+			name:       "flag over environment and config file",
+			args:       []string{"--count", "7"},
+			env:        map[string]string{"DUMPPCAP_COUNT": "5", "DUMPPCAP_INTERVAL": "1s"},
+			file:       `{"count": 3, "interval": "2s", "host-header": "file.example"}`,
+			count:      7,
+			interval:   time.Second,
+			hostHeader: "file.example",
+		},
+		{
+			name:       "flag set to its default still wins",
+			args:       []string{"--count=0", "--host-header=default.example"},
+			env:        map[string]string{"DUMPPCAP_COUNT": "5"},
+			file:       `{"host-header": "file.example"}`,
+			hostHeader: "default.example",
+		},
+		{
+			name:       "env prefix",
+			args:       []string{"--env-prefix", "PROBE_"},
+			env:        map[string]string{"DUMPPCAP_COUNT": "5", "PROBE_COUNT": "9"},
+			count:      9,
+			hostHeader: "default.example",
+		},
+		{
+			name:       "config file from the environment",
+			file:       `{"count": 4}`,
+			fileInEnv:  true,
+			count:      4,
+			hostHeader: "default.example",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			switch {
+			case tt.fileInEnv:
+				t.Setenv("DUMPPCAP_CONFIG", writeConfigFile(t, tt.file))
+			case tt.file != "":
+				args = append(args, "--config", writeConfigFile(t, tt.file))
+			}
+
+			cfg := &Config{}
+			fs := newTestFlagSet(cfg)
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			if err := resolveConfig(fs, cfg); err != nil {
+				t.Fatalf("resolveConfig: %v", err)
+			}
+			if cfg.Count != tt.count {
+				t.Errorf("count = %d, want %d", cfg.Count, tt.count)
+			}
+			if cfg.Interval != tt.interval {
+				t.Errorf("interval = %s, want %s", cfg.Interval, tt.interval)
+			}
+			if cfg.HostHeader != tt.hostHeader {
+				t.Errorf("host-header = %q, want %q", cfg.HostHeader, tt.hostHeader)
+			}
+		})
+	}
+}
+
+func TestResolveConfigRepeatable(t *testing.T) {
+	cfg := &Config{}
+	fs := newTestFlagSet(cfg)
+	path := writeConfigFile(t, `{"H": ["X-A: 1", "X-B: 2"]}`)
+	if err := fs.Parse([]string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveConfig(fs, cfg); err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if got := cfg.Headers.String(); !strings.Contains(got, "X-A") || !strings.Contains(got, "X-B") {
+		t.Errorf("headers = %q, want X-A and X-B", got)
+	}
+}
+
+func TestResolveConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		file string
+		want string
+	}{
+		{
+			name: "malformed JSON",
+			file: `{"count": 3,`,
+			want: "config.json",
+		},
+		{
+			name: "not an object",
+			file: `[1, 2]`,
+			want: "config.json",
+		},
+		{
+			name: "unknown flag",
+			file: `{"cuont": 3}`,
+			want: `unknown flag "cuont"`,
+		},
+		{
+			name: "bad value in the config file",
+			file: `{"count": "many"}`,
+			want: "config.json: count",
+		},
+		{
+			name: "bad value in the environment",
+			env:  map[string]string{"DUMPPCAP_INTERVAL": "soon"},
+			want: "DUMPPCAP_INTERVAL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			var args []string
+			if tt.file != "" {
+				args = []string{"--config", writeConfigFile(t, tt.file)}
+			}
+
+			cfg := &Config{}
+			fs := newTestFlagSet(cfg)
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			err := resolveConfig(fs, cfg)
+			if err == nil {
+				t.Fatalf("resolveConfig succeeded, want an error with %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q doesn't contain %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		cfg := &Config{}
+		fs := newTestFlagSet(cfg)
+		if err := fs.Parse([]string{"--config", filepath.Join(t.TempDir(), "none.json")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := resolveConfig(fs, cfg); !os.IsNotExist(err) {
+			t.Errorf("resolveConfig: %v, want a not exist error", err)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// countDown shows the progress of a --count bounded run on a single line
+// that is updated in place.
+type countDown struct {
+	total   int
+	ok      int
+	retried int
+	failed  int
+}
+
+func (c *countDown) show(attempt int) {
+	fmt.Printf("\rattempt %d/%d  ok %d  retried %d  failed %d ", attempt, c.total, c.ok, c.retried, c.failed)
+}
+
+func (c *countDown) record(result *RequestResult) {
+	switch {
+	case result == nil || result.Error != "":
+		c.failed++
+	case result.Retry != nil:
+		c.retried++
+	default:
+		c.ok++
+	}
+}
+
+func (c *countDown) done(attempt int) {
+	c.show(attempt)
+	fmt.Println()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// curlCommand returns a curl command line that repeats req. Values of
+// sensitive headers are [REDACTED] and have to be filled in by hand.
+func curlCommand(req *http.Request, cfg *Config) string {
+	args := []string{"curl", "-v"}
+	if req.Method != http.MethodGet {
+		args = append(args, "-X", req.Method)
+	}
+	if cfg.HTTP3 {
+		args = append(args, "--http3-only")
+	} else if cfg.HTTP2 {
+		args = append(args, "--http2")
+	} else {
+		args = append(args, "--http1.1")
+	}
+
+	u := *req.URL
+	host := req.Host
+	if cfg.TLSServerName != "" {
+		// curl sends the URL host as SNI, so go to the SNI name and connect
+		// to the real host instead.
+		if host == "" {
+			host = u.Host
+		}
+		port := u.Port()
+		if port == "" {
+			port = "443"
+			u.Host = cfg.TLSServerName
+		} else {
+			u.Host = net.JoinHostPort(cfg.TLSServerName, port)
+		}
+		args = append(args, "--connect-to", cfg.TLSServerName+":"+port+":"+req.URL.Hostname()+":"+port)
+	}
+	for _, rule := range cfg.ConnectTo {
+		args = append(args, "--connect-to", rule.String())
+	}
+	if host != "" && host != u.Host {
+		args = append(args, "-H", "Host: "+host)
+	}
+
+	keys := make([]string, 0, len(req.Header))
+	for key := range req.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range redactHeader(key, req.Header[key]) {
+			args = append(args, "-H", key+": "+value)
+		}
+	}
+	if cfg.BodySize > 0 {
+		// The generated body isn't printable, curl reads it from stdin.
+		args = append(args, "--data-binary", "@-")
+	} else if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			if b, err := io.ReadAll(body); err == nil && len(b) > 0 {
+				args = append(args, "--data-raw", string(b))
+			}
+		}
+	}
+	args = append(args, u.String())
+
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	cmd := strings.Join(args, " ")
+	if cfg.BodySize > 0 {
+		source := "/dev/zero"
+		if cfg.BodyFill == "random" {
+			source = "/dev/urandom"
+		}
+		cmd = fmt.Sprintf("head -c %d %s | %s", cfg.BodySize, source, cmd)
+	}
+	return cmd
+}
+
+// shellQuote quotes s for a POSIX shell when needed.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,%+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	tracerouteMaxHops = 20
+	tracerouteWait    = time.Second
+	traceroutePort    = 33434 // the first destination port of traceroute
+)
+
+// diagCategories are the error categories --diag-on-failure runs a
+// traceroute for.
+var diagCategories = map[string]bool{
+	"conn_refused":    true,
+	"conn_reset":      true,
+	"unreachable":     true,
+	"connect_timeout": true,
+	"timeout":         true,
+	"eof":             true,
+}
+
+type hop struct {
+	TTL  int    `json:"ttl"`
+	Addr string `json:"addr,omitempty"`
+	RTT  string `json:"rtt,omitempty"`
+}
+
+// lastConnectAddr returns the IP of the last connect of stages.
+func lastConnectAddr(stages []Stage) net.IP {
+	for i := len(stages) - 1; i >= 0; i-- {
+		if stages[i].Name != "ConnectStart" {
+			continue
+		}
+		addr, _ := stages[i].Values["addr"].(string)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// tracerouteStage runs a traceroute to the address the request last
+// connected to.
+func tracerouteStage(stages []Stage) Stage {
+	ip := lastConnectAddr(stages)
+	if ip == nil {
+		return newStage("Traceroute", map[string]interface{}{
+			"error": "no address was connected to",
+		})
+	}
+	hops, err := traceroute(ip)
+	return newStage("Traceroute", map[string]interface{}{
+		"target": ip.String(),
+		"hops":   hops,
+		"error":  errString(err),
+	})
+}
+
+// traceroute sends UDP probes with increasing TTLs to ip and records the
+// routers answering with ICMP time exceeded, like `traceroute -n -q 1`. It
+// stops at the port unreachable of ip. Reading ICMP needs a raw socket, so
+// root or CAP_NET_RAW.
+func traceroute(ip net.IP) ([]hop, error) {
+	if ip.To4() == nil {
+		return nil, errors.New("traceroute only supports IPv4")
+	}
+
+	icmpConn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	defer icmpConn.Close()
+	udpConn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer udpConn.Close()
+	probes := ipv4.NewPacketConn(udpConn)
+	localPort := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	var hops []hop
+	buf := make([]byte, 1500)
+	for ttl := 1; ttl <= tracerouteMaxHops; ttl++ {
+		if err := probes.SetTTL(ttl); err != nil {
+			return hops, err
+		}
+		port := traceroutePort + ttl
+		start := time.Now()
+		if _, err := udpConn.WriteTo([]byte("dump-pcap"), &net.UDPAddr{IP: ip, Port: port}); err != nil {
+			return hops, err
+		}
+
+		h := hop{TTL: ttl}
+		reached := false
+		_ = icmpConn.SetReadDeadline(start.Add(tracerouteWait))
+		for {
+			n, peer, err := icmpConn.ReadFrom(buf)
+			if err != nil {
+				break // no answer for this TTL
+			}
+			msg, err := icmp.ParseMessage(1, buf[:n])
+			if err != nil {
+				continue
+			}
+			var data []byte
+			switch body := msg.Body.(type) {
+			case *icmp.TimeExceeded:
+				data = body.Data
+			case *icmp.DstUnreach:
+				data = body.Data
+				reached = true
+			default:
+				continue
+			}
+			if !isProbe(data, localPort, port) {
+				reached = false
+				continue
+			}
+			h.Addr = peer.String()
+			h.RTT = time.Since(start).String()
+			break
+		}
+		hops = append(hops, h)
+		if reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// isProbe reports whether the IPv4 and UDP headers quoted by an ICMP error
+// are the ones of a probe.
+func isProbe(data []byte, srcPort, dstPort int) bool {
+	if len(data) < ipv4.HeaderLen {
+		return false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+4 {
+		return false
+	}
+	return int(binary.BigEndian.Uint16(data[ihl:])) == srcPort &&
+		int(binary.BigEndian.Uint16(data[ihl+2:])) == dstPort
+}
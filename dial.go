@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newDialer returns a dialer with the same settings as http.DefaultTransport.
+func newDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// TLS record content types and handshake message types of the handshake
+// timing.
+const (
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+
+	tlsClientHello = 1
+	tlsServerHello = 2
+)
+
+// tlsRecord returns the content type of the TLS record b starts with, and the
+// handshake message type of a handshake record, 0 when b isn't a TLS record
+// such as the CONNECT of a proxy or a plain HTTP request.
+func tlsRecord(b []byte) (contentType, handshakeType byte) {
+	if len(b) < 5 || b[1] != 3 {
+		return 0, 0
+	}
+	switch b[0] {
+	case tlsRecordHandshake:
+		if len(b) > 5 {
+			return b[0], b[5]
+		}
+		return b[0], 0
+	case tlsRecordChangeCipherSpec, tlsRecordApplicationData:
+		return b[0], 0
+	}
+	return 0, 0
+}
+
+// handshakeTimingConn records when the first bytes of the TLS handshake go
+// over the wire, from the TLS records: the write of the ClientHello, the read
+// of the ServerHello and the next write, the client's Finished flight. Bytes
+// before the handshake, such as a proxy CONNECT, aren't counted, and nothing
+// is recorded without TLS. The boundaries are approximate, a flight taking
+// several writes or reads.
+type handshakeTimingConn struct {
+	net.Conn
+	trace *BufferedClientTrace
+
+	mu            sync.Mutex
+	helloSent     bool
+	helloReceived bool
+	finishedSent  bool
+}
+
+func (c *handshakeTimingConn) Write(b []byte) (int, error) {
+	contentType, handshakeType := tlsRecord(b)
+	n, err := c.Conn.Write(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case !c.helloSent && handshakeType == tlsClientHello:
+		c.helloSent = true
+		c.trace.add("TLSClientHelloSent", map[string]interface{}{
+			"bytes": n,
+		})
+	case c.helloReceived && !c.finishedSent && contentType != 0:
+		c.finishedSent = true
+		c.trace.add("TLSClientFinishedSent", map[string]interface{}{
+			"bytes": n,
+		})
+	}
+
+	return n, err
+}
+
+func (c *handshakeTimingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.helloSent || c.helloReceived {
+		return n, err
+	}
+	// The ServerHello is the first handshake record of the server, its type
+	// being in the next read when the record header comes alone.
+	if contentType, handshakeType := tlsRecord(b[:n]); contentType == tlsRecordHandshake && (handshakeType == tlsServerHello || handshakeType == 0) {
+		c.helloReceived = true
+		c.trace.add("TLSServerHelloReceived", map[string]interface{}{
+			"bytes": n,
+		})
+	}
+
+	return n, err
+}
+
+func handshakeTimingDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		trace := bufferedClientTraceFrom(ctx)
+		if trace == nil {
+			return conn, nil
+		}
+		return &handshakeTimingConn{Conn: conn, trace: trace}, nil
+	}
+}
+
+// tcpKeepAlive is --tcp-keepalive: off, on, or the idle, interval and count
+// of the probes, e.g. idle=30s,interval=10s,count=3. Unset fields keep the
+// defaults of Go (15s, 15s and 9).
+type tcpKeepAlive struct {
+	set bool
+	net.KeepAliveConfig
+}
+
+func (k *tcpKeepAlive) String() string {
+	switch {
+	case !k.set:
+		return ""
+	case !k.Enable:
+		return "off"
+	}
+	return fmt.Sprintf("idle=%s,interval=%s,count=%d", k.Idle, k.Interval, k.Count)
+}
+
+func (k *tcpKeepAlive) Set(value string) error {
+	ka := tcpKeepAlive{set: true, KeepAliveConfig: net.KeepAliveConfig{Enable: true}}
+	switch value {
+	case "off":
+		ka.Enable = false
+	case "on":
+	default:
+		for _, pair := range strings.Split(value, ",") {
+			key, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			var err error
+			switch key {
+			case "idle":
+				ka.Idle, err = time.ParseDuration(v)
+			case "interval":
+				ka.Interval, err = time.ParseDuration(v)
+			case "count":
+				ka.Count, err = strconv.Atoi(v)
+			default:
+				return fmt.Errorf("invalid TCP keep-alive %q, want off, on or idle=D,interval=D,count=N", pair)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid TCP keep-alive %s: %w", key, err)
+			}
+		}
+	}
+	*k = ka
+	return nil
+}
+
+// apply configures the keep-alives of the connections of dialer.
+func (k *tcpKeepAlive) apply(dialer *net.Dialer) {
+	dialer.KeepAliveConfig = k.KeepAliveConfig
+	if !k.Enable {
+		dialer.KeepAlive = -1
+	}
+}
+
+func (k *tcpKeepAlive) values() map[string]interface{} {
+	setting := func(d time.Duration) string {
+		if d == 0 {
+			return "default"
+		}
+		return d.String()
+	}
+	values := map[string]interface{}{
+		"enabled": k.Enable,
+	}
+	if k.Enable {
+		values["idle"] = setting(k.Idle)
+		values["interval"] = setting(k.Interval)
+		values["count"] = "default"
+		if k.Count != 0 {
+			values["count"] = k.Count
+		}
+	}
+	return values
+}
+
+// keepAliveDial records the TCP keep-alive settings the dialer applied to
+// every connection.
+func keepAliveDial(dial dialFunc, ka *tcpKeepAlive) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if trace := bufferedClientTraceFrom(ctx); trace != nil {
+			values := ka.values()
+			values["addr"] = conn.RemoteAddr().String()
+			trace.add("TCPKeepAlive", values)
+		}
+		return conn, nil
+	}
+}
+
+// connectToRule is a --connect-to rule: connections to host:port go to
+// connectHost:connectPort instead. Empty fields match any host or port, or
+// keep the original one.
+type connectToRule struct {
+	host, port               string
+	connectHost, connectPort string
+}
+
+func (c connectToRule) String() string {
+	join := func(host, port string) string {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return host + ":" + port
+	}
+	return join(c.host, c.port) + ":" + join(c.connectHost, c.connectPort)
+}
+
+// connectToRules are the rules of --connect-to, which can be repeated, the
+// first matching one applying as with curl.
+type connectToRules []connectToRule
+
+func (l *connectToRules) String() string {
+	rules := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+func (l *connectToRules) Set(value string) error {
+	fields, err := splitConnectTo(value)
+	if err != nil {
+		return err
+	}
+	for _, port := range []string{fields[1], fields[3]} {
+		if n, err := strconv.Atoi(port); port != "" && (err != nil || n <= 0 || n > 65535) {
+			return fmt.Errorf("invalid port %q in --connect-to %q", port, value)
+		}
+	}
+	*l = append(*l, connectToRule{host: fields[0], port: fields[1], connectHost: fields[2], connectPort: fields[3]})
+	return nil
+}
+
+// splitConnectTo splits host:port:connecthost:connectport, hosts being IPv6
+// addresses in brackets.
+func splitConnectTo(value string) ([]string, error) {
+	var fields []string
+	rest := value
+	for len(fields) < 4 {
+		field := ""
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unbalanced brackets in --connect-to %q", value)
+			}
+			field, rest = rest[1:end], rest[end+1:]
+		} else if i := strings.Index(rest, ":"); i >= 0 {
+			field, rest = rest[:i], rest[i:]
+		} else {
+			field, rest = rest, ""
+		}
+		fields = append(fields, field)
+		if len(fields) < 4 {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, fmt.Errorf("invalid --connect-to %q, want host:port:connecthost:connectport", value)
+			}
+			rest = rest[1:]
+		}
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid --connect-to %q, want host:port:connecthost:connectport", value)
+	}
+	return fields, nil
+}
+
+// connectToDial dials the address of the first rule matching addr instead,
+// leaving the URL, and so the Host header and SNI, as they were. A ConnectTo
+// stage records the address of the URL and the one dialed.
+func connectToDial(dial dialFunc, rules connectToRules) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		for _, rule := range rules {
+			if (rule.host != "" && !strings.EqualFold(rule.host, host)) || (rule.port != "" && rule.port != port) {
+				continue
+			}
+			connectHost, connectPort := host, port
+			if rule.connectHost != "" {
+				connectHost = rule.connectHost
+			}
+			if rule.connectPort != "" {
+				connectPort = rule.connectPort
+			}
+			connectAddr := net.JoinHostPort(connectHost, connectPort)
+			if trace := bufferedClientTraceFrom(ctx); trace != nil {
+				trace.add("ConnectTo", map[string]interface{}{
+					"logical":  addr,
+					"physical": connectAddr,
+					"rule":     rule.String(),
+				})
+			}
+			return dial(ctx, network, connectAddr)
+		}
+		return dial(ctx, network, addr)
+	}
+}
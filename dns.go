@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// nameserverDial is a connection the resolver of --trace-dns-servers made to
+// a nameserver.
+type nameserverDial struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	Error   string `json:"error,omitempty"`
+}
+
+// tracingResolver returns a pure Go resolver that records the nameservers it
+// dials in the trace of the request, and the queries it sends and the CNAMEs
+// it's answered over them. The Go resolver tries the nameservers in order
+// and dials again for every one, so the last dial of a successful lookup is
+// the nameserver that answered.
+func tracingResolver() *net.Resolver {
+	var dialer net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			trace := bufferedClientTraceFrom(ctx)
+			if trace == nil {
+				return conn, err
+			}
+			trace.addNameserver(nameserverDial{
+				Network: network,
+				Addr:    address,
+				Error:   errString(err),
+			})
+			if err != nil {
+				return nil, err
+			}
+			// The resolver frames the messages by whether the
+			// connection is a PacketConn.
+			if packet, ok := conn.(net.PacketConn); ok {
+				return &dnsPacketConn{dnsConn: &dnsConn{Conn: conn, trace: trace}, PacketConn: packet}, nil
+			}
+			return &dnsConn{Conn: conn, trace: trace, stream: true}, nil
+		},
+	}
+}
+
+// dnsConn follows the messages of the resolver with a nameserver: the
+// queries written and the CNAMEs of the answers read. Over TCP messages are
+// prefixed with their length and may take several reads.
+type dnsConn struct {
+	net.Conn
+	trace  *BufferedClientTrace
+	stream bool
+	read   []byte
+}
+
+// dnsPacketConn is a dnsConn over UDP.
+type dnsPacketConn struct {
+	*dnsConn
+	net.PacketConn
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	msg := b[:n]
+	if c.stream && len(msg) >= 2 {
+		msg = msg[2:]
+	}
+	c.trace.observeDNS(msg)
+	return n, err
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stream {
+		c.trace.observeDNS(b[:n])
+		return n, err
+	}
+	c.read = append(c.read, b[:n]...)
+	for len(c.read) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.read))
+		if len(c.read) < 2+size {
+			break
+		}
+		c.trace.observeDNS(c.read[2 : 2+size])
+		c.read = c.read[2+size:]
+	}
+	return n, err
+}
+
+// observeDNS counts msg if it's a query, or records its CNAMEs if it's an
+// answer.
+func (t *BufferedClientTrace) observeDNS(msg []byte) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return
+	}
+	t.nsMu.Lock()
+	defer t.nsMu.Unlock()
+	if !header.Response {
+		t.dnsQueries++
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		answer, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		if answer.Type != dnsmessage.TypeCNAME {
+			if p.SkipAnswer() != nil {
+				return
+			}
+			continue
+		}
+		cname, err := p.CNAMEResource()
+		if err != nil {
+			return
+		}
+		if t.cnames == nil {
+			t.cnames = map[string]string{}
+		}
+		t.cnames[answer.Name.String()] = cname.CNAME.String()
+	}
+}
+
+// maxCNAMEChain bounds the CNAME chain followed, against loops.
+const maxCNAMEChain = 16
+
+// cnameChain returns the names from host to the last CNAME of cnames, nil
+// without CNAME. With a search domain the chain starts at the name of host
+// that was answered.
+func cnameChain(host string, cnames map[string]string) []string {
+	if len(cnames) == 0 {
+		return nil
+	}
+	start := host + "."
+	if _, ok := cnames[start]; !ok {
+		targets := map[string]bool{}
+		for _, to := range cnames {
+			targets[to] = true
+		}
+		for from := range cnames {
+			if !targets[from] {
+				start = from
+				break
+			}
+		}
+	}
+	chain := []string{start}
+	for name := start; len(chain) <= maxCNAMEChain; {
+		to, ok := cnames[name]
+		if !ok {
+			break
+		}
+		chain = append(chain, to)
+		name = to
+	}
+	return chain
+}
+
+// warmDNS holds the addresses of the target host resolved once before the
+// loop with --warm-dns, so requests connect without a lookup.
+type warmDNS struct {
+	host  string
+	addrs []net.IPAddr
+}
+
+func newWarmDNS(ctx context.Context, rawURL string) (*warmDNS, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return &warmDNS{host: host, addrs: addrs}, nil
+}
+
+// dial connects to the cached addresses of the host in turn, as the dialer
+// does with those of a lookup, and to any other host through dial. Every
+// address gets the full connect timeout.
+func (w *warmDNS) dial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host != w.host {
+			return dial(ctx, network, addr)
+		}
+		if trace := bufferedClientTraceFrom(ctx); trace != nil {
+			trace.warmDNS.Store(true)
+			trace.add("DNSWarmCache", map[string]interface{}{
+				"host":  host,
+				"addrs": w.addrs,
+			})
+		}
+
+		var errs []error
+		for _, ip := range w.addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ElasticsearchExporter bulk-indexes every result into a daily index named
+// after the date of the request, e.g. dump-pcap-2026.10.15. Documents are
+// buffered and sent every flush interval in the background, so an
+// unavailable cluster or index only prints warnings instead of stalling the
+// loop; the documents of a failed bulk request are dropped. The warnings go
+// to stderr since flushes mostly happen between runs, when no run log is
+// open.
+type ElasticsearchExporter struct {
+	bulkURL string
+	index   string
+	client  *http.Client
+
+	mu      sync.Mutex
+	pending bytes.Buffer
+	docs    int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewElasticsearchExporter(esURL, index string, interval time.Duration) (*ElasticsearchExporter, error) {
+	if esURL == "" {
+		return nil, errors.New("--elasticsearch-url is required")
+	}
+	if interval <= 0 {
+		return nil, errors.New("--elasticsearch-flush-interval must be positive")
+	}
+
+	e := &ElasticsearchExporter{
+		bulkURL: strings.TrimSuffix(esURL, "/") + "/_bulk",
+		index:   index,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.run(interval)
+
+	return e, nil
+}
+
+func (e *ElasticsearchExporter) Export(runID string, result *RequestResult) error {
+	doc := result.record(runID)
+	doc["@timestamp"] = result.Start
+	if u, err := url.Parse(result.URL); err == nil {
+		doc["host"] = u.Host
+	}
+	doc["outcome"] = "success"
+	if result.Error != "" {
+		doc["outcome"] = "failure"
+	}
+
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": e.index + "-" + result.Start.UTC().Format("2006.01.02")},
+	})
+	if err != nil {
+		return err
+	}
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending.Write(action)
+	e.pending.WriteByte('\n')
+	e.pending.Write(source)
+	e.pending.WriteByte('\n')
+	e.docs++
+	return nil
+}
+
+func (e *ElasticsearchExporter) run(interval time.Duration) {
+	defer close(e.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-e.stop:
+			e.flush()
+			return
+		}
+	}
+}
+
+// flush sends the pending documents in one bulk request.
+func (e *ElasticsearchExporter) flush() {
+	e.mu.Lock()
+	body := bytes.Clone(e.pending.Bytes())
+	docs := e.docs
+	e.pending.Reset()
+	e.docs = 0
+	e.mu.Unlock()
+	if docs == 0 {
+		return
+	}
+
+	if err := e.bulk(body); err != nil {
+		fmt.Fprintf(os.Stderr, "Error indexing %d results in Elasticsearch: %v\n", docs, err)
+	}
+}
+
+func (e *ElasticsearchExporter) bulk(body []byte) error {
+	resp, err := e.client.Post(e.bulkURL, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("elasticsearch returned %s", resp.Status)
+	}
+
+	// A bulk request succeeds as a whole even when some documents were
+	// rejected, e.g. by a closed or read-only index.
+	var bulkResp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bulkResp); err != nil {
+		return fmt.Errorf("decoding bulk response: %w", err)
+	}
+	if !bulkResp.Errors {
+		return nil
+	}
+	failed := 0
+	var first string
+	for _, item := range bulkResp.Items {
+		for _, op := range item {
+			if op.Status/100 != 2 {
+				failed++
+				if first == "" {
+					first = op.Error.Type + ": " + op.Error.Reason
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%d of %d documents rejected, first by %s", failed, len(bulkResp.Items), first)
+}
+
+// Close sends the pending documents.
+func (e *ElasticsearchExporter) Close() error {
+	close(e.stop)
+	<-e.done
+	return nil
+}
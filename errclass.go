@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// errorCategories are the categories of errorCategory, body_mismatch of
+// --expect-sha256, phase_budget of --phase-budget and watchdog of
+// --watchdog-timeout.
+var errorCategories = []string{"dns", "conn_refused", "conn_reset", "unreachable", "tls", "connect_timeout", "timeout", "eof", "canceled", "http_downgrade", "body_mismatch", "phase_budget", "watchdog", "other"}
+
+// errorCategoryList is a comma-separated list of error categories.
+type errorCategoryList []string
+
+func (l *errorCategoryList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *errorCategoryList) Set(value string) error {
+	categories := strings.Split(value, ",")
+	for _, category := range categories {
+		if !slices.Contains(errorCategories, category) {
+			return fmt.Errorf("unknown error category %q, must be one of %s", category, strings.Join(errorCategories, ", "))
+		}
+	}
+	*l = categories
+	return nil
+}
+
+// errorCategory classifies the error of a failed request, "" when there is
+// none.
+func errorCategory(err error) string {
+	var dnsErr *net.DNSError
+	var verifyErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "conn_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "conn_reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &verifyErr), errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return "tls"
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return "connect_timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, errHTTPDowngrade):
+		return "http_downgrade"
+	}
+	return "other"
+}
+
+// addErrno adds the errno wrapped by err to values: its number (`errno`),
+// its name (`errnoName`, empty where unknown) and the system call that
+// returned it (`syscall`) when err says. Unlike the text of err, it's the
+// same whatever the platform words it as.
+func addErrno(values map[string]interface{}, err error) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return
+	}
+	values["errno"] = int(errno)
+	values["errnoName"] = errnoName(errno)
+	var sysErr *os.SyscallError
+	if errors.As(err, &sysErr) {
+		values["syscall"] = sysErr.Syscall
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// errnoName returns the symbolic name of errno, such as ECONNREFUSED, ""
+// when unknown.
+func errnoName(errno syscall.Errno) string {
+	return unix.ErrnoName(errno)
+}
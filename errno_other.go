@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package main
+
+import "syscall"
+
+func errnoName(errno syscall.Errno) string {
+	return ""
+}
@@ -0,0 +1,99 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestAddErrno(t *testing.T) {
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name    string
+		err     error
+		errno   syscall.Errno
+		errName string
+		syscall string
+	}{
+		{
+			name:    "refused",
+			err:     dialErr(syscall.ECONNREFUSED),
+			errno:   syscall.ECONNREFUSED,
+			errName: "ECONNREFUSED",
+			syscall: "connect",
+		},
+		{
+			name:    "reset on read",
+			err:     &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			errno:   syscall.ECONNRESET,
+			errName: "ECONNRESET",
+			syscall: "read",
+		},
+		{
+			name:    "timed out",
+			err:     dialErr(syscall.ETIMEDOUT),
+			errno:   syscall.ETIMEDOUT,
+			errName: "ETIMEDOUT",
+			syscall: "connect",
+		},
+		{
+			name:    "host unreachable",
+			err:     dialErr(syscall.EHOSTUNREACH),
+			errno:   syscall.EHOSTUNREACH,
+			errName: "EHOSTUNREACH",
+			syscall: "connect",
+		},
+		{
+			name:    "wrapped by the client",
+			err:     &url.Error{Op: "Get", URL: "https://example.com", Err: dialErr(syscall.ECONNREFUSED)},
+			errno:   syscall.ECONNREFUSED,
+			errName: "ECONNREFUSED",
+			syscall: "connect",
+		},
+		{
+			name:    "without the system call",
+			err:     fmt.Errorf("dial: %w", syscall.EHOSTUNREACH),
+			errno:   syscall.EHOSTUNREACH,
+			errName: "EHOSTUNREACH",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[string]interface{}{}
+			addErrno(values, tt.err)
+			if got := values["errno"]; got != int(tt.errno) {
+				t.Errorf("errno = %v, want %d", got, int(tt.errno))
+			}
+			if got := values["errnoName"]; got != tt.errName {
+				t.Errorf("errnoName = %v, want %s", got, tt.errName)
+			}
+			if got, ok := values["syscall"]; tt.syscall == "" && ok {
+				t.Errorf("syscall = %v, want none", got)
+			} else if tt.syscall != "" && got != tt.syscall {
+				t.Errorf("syscall = %v, want %s", got, tt.syscall)
+			}
+		})
+	}
+}
+
+func TestAddErrnoWithoutErrno(t *testing.T) {
+	for _, err := range []error{
+		nil,
+		errors.New("no errno"),
+		&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}},
+	} {
+		values := map[string]interface{}{}
+		addErrno(values, err)
+		if len(values) != 0 {
+			t.Errorf("addErrno(%v) added %v, want nothing", err, values)
+		}
+	}
+}
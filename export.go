@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exporter writes the result of every request somewhere.
+type Exporter interface {
+	Export(runID string, result *RequestResult) error
+	Close() error
+}
+
+var outputFormats = []string{"json", "ndjson", "csv", "har", "chrome", "otlp", "kafka", "elasticsearch", "loki", "jaeger", "protobuf"}
+
+// outputFormatList is a comma-separated list of output formats.
+type outputFormatList []string
+
+func (l *outputFormatList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *outputFormatList) Set(value string) error {
+	formats := strings.Split(value, ",")
+	for _, format := range formats {
+		if !slices.Contains(outputFormats, format) {
+			return fmt.Errorf("unknown format %q, must be one of %s", format, strings.Join(outputFormats, ", "))
+		}
+	}
+	*l = formats
+	return nil
+}
+
+// newExporter returns the exporter of format. The exporters that write a
+// file per run name it with filePath.
+func newExporter(format string, cfg *Config, logger *logrus.Logger, filePath func(suffix string) (string, error)) (Exporter, error) {
+	switch format {
+	case "json":
+		return &JSONExporter{logger: logger, perStage: cfg.LogPerStage}, nil
+	case "ndjson":
+		return NewNDJSONExporter("out/results.ndjson")
+	case "csv":
+		return NewCSVExporter("out/results.csv")
+	case "har":
+		return &HARExporter{filePath: filePath}, nil
+	case "chrome":
+		return &ChromeExporter{filePath: filePath}, nil
+	case "otlp":
+		return NewOTLPExporter(cfg.OTLPEndpoint), nil
+	case "kafka":
+		return NewKafkaExporter(cfg.KafkaBrokers, cfg.KafkaTopic, logger)
+	case "elasticsearch":
+		return NewElasticsearchExporter(cfg.ElasticURL, cfg.ElasticIndex, cfg.ElasticFlush)
+	case "loki":
+		return NewLokiExporter(cfg.LokiURL, cfg.LokiFlush)
+	case "jaeger":
+		return NewJaegerExporter(cfg.JaegerEndpoint), nil
+	case "protobuf":
+		return NewProtobufExporter("out/results.pb")
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// MultiExporter fans out every result to several exporters.
+type MultiExporter []Exporter
+
+func (m MultiExporter) Export(runID string, result *RequestResult) error {
+	var errs []error
+	for _, e := range m {
+		if err := e.Export(runID, result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m MultiExporter) Close() error {
+	var errs []error
+	for _, e := range m {
+		if err := e.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stepSuffix numbers the suffix of the file of a --sequence step, e.g.
+// -step2.har, so the steps of a run don't overwrite each other's file.
+func stepSuffix(result *RequestResult, suffix string) string {
+	if result.Step == 0 {
+		return suffix
+	}
+	return fmt.Sprintf("-step%d%s", result.Step, suffix)
+}
+
+// JSONExporter logs the result as a single entry of the run log, which is
+// what compare reads back. With perStage every stage is an entry of its own
+// and the result entry goes without them.
+type JSONExporter struct {
+	logger   *logrus.Logger
+	perStage bool
+}
+
+func (e *JSONExporter) Export(runID string, result *RequestResult) error {
+	entry := e.logger.WithField("schemaVersion", schemaVersion).WithField("runID", runID)
+	if result.RemoteAddr != "" {
+		entry = entry.WithField("remoteAddr", result.RemoteAddr)
+	}
+	if result.SessionID != "" {
+		entry = entry.WithField("sessionID", result.SessionID).WithField("step", result.Step)
+	}
+	if e.perStage {
+		e.logStages(runID, result.Stages)
+		entry = entry.WithField("stageCount", len(result.Stages))
+	} else {
+		entry = entry.WithField("stages", result.Stages)
+	}
+	if attempts := result.attemptRecords(); attempts != nil {
+		entry = entry.WithField("attempts", attempts)
+	}
+	if result.Error != "" {
+		entry.WithField("error", result.Error).WithField("errorCategory", result.ErrorCategory).Error("Error requesting traefik releases")
+		return nil
+	}
+	entry.WithField("status", result.Status).Info("Requested traefik releases")
+	return nil
+}
+
+// logStages logs an entry per stage, numbered by seq in the order of the
+// stages, with the time elapsed since the first one.
+func (e *JSONExporter) logStages(runID string, stages []Stage) {
+	for i, stage := range stages {
+		e.logger.WithFields(logrus.Fields{
+			"schemaVersion": schemaVersion,
+			"runID":         runID,
+			"seq":           i,
+			"stage":         stage.Name,
+			"stageTime":     stage.Time,
+			"values":        stage.Values,
+			"elapsedMs":     float64(stage.Time.Sub(stages[0].Time)) / float64(time.Millisecond),
+		}).Info("Stage")
+	}
+}
+
+func (e *JSONExporter) Close() error {
+	return nil
+}
+
+type NDJSONExporter struct {
+	f *os.File
+}
+
+func NewNDJSONExporter(path string) (*NDJSONExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &NDJSONExporter{f: f}, nil
+}
+
+func (e *NDJSONExporter) Export(runID string, result *RequestResult) error {
+	return json.NewEncoder(e.f).Encode(result.record(runID))
+}
+
+func (e *NDJSONExporter) Close() error {
+	return e.f.Close()
+}
+
+var csvColumns = append([]string{"runID", "start", "url", "status", "error"}, append(phaseNames(), "total")...)
+
+type CSVExporter struct {
+	f *os.File
+	w *csv.Writer
+}
+
+func NewCSVExporter(path string) (*CSVExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &CSVExporter{f: f, w: csv.NewWriter(f)}
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		if err := e.w.Write(csvColumns); err != nil {
+			f.Close()
+			return nil, err
+		}
+		e.w.Flush()
+	}
+
+	return e, nil
+}
+
+func (e *CSVExporter) Export(runID string, result *RequestResult) error {
+	record := []string{
+		runID,
+		result.Start.Format(time.RFC3339Nano),
+		result.URL,
+		strconv.Itoa(result.Status),
+		result.Error,
+	}
+	ms := result.durationsMs()
+	for _, name := range csvColumns[len(record):] {
+		if d, ok := ms[name]; ok {
+			record = append(record, strconv.FormatFloat(d, 'f', 3, 64))
+		} else {
+			record = append(record, "")
+		}
+	}
+
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *CSVExporter) Close() error {
+	return e.f.Close()
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
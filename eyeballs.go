@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type dialAttempt struct {
+	Family   string    `json:"family"`
+	Addr     string    `json:"addr"`
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// splitByFamily keeps the resolver order and puts the family of the first
+// address first, as in RFC 6555.
+func splitByFamily(addrs []net.IPAddr) (primaries, fallbacks []net.IPAddr) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	primary := ipFamily(addrs[0].IP)
+	for _, addr := range addrs {
+		if ipFamily(addr.IP) == primary {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// happyEyeballsDial races the two address families like the net package
+// does, but records every connect attempt and which family won.
+func happyEyeballsDial(dialer *net.Dialer, fallbackDelay time.Duration) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		resolver := dialer.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		primaries, fallbacks := splitByFamily(ips)
+
+		var mu sync.Mutex
+		var attempts []dialAttempt
+		dialSerial := func(ctx context.Context, addrs []net.IPAddr) (net.Conn, error) {
+			var lastErr error
+			for _, ip := range addrs {
+				target := net.JoinHostPort(ip.String(), port)
+				start := time.Now()
+				conn, err := dialer.DialContext(ctx, network, target)
+				attempt := dialAttempt{
+					Family:   ipFamily(ip.IP),
+					Addr:     target,
+					Start:    start,
+					Duration: time.Since(start).String(),
+				}
+				if err != nil {
+					attempt.Error = err.Error()
+				}
+				mu.Lock()
+				attempts = append(attempts, attempt)
+				mu.Unlock()
+				if err == nil {
+					return conn, nil
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		}
+
+		type dialResult struct {
+			conn    net.Conn
+			err     error
+			primary bool
+			family  string
+		}
+		dialCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := make(chan dialResult)
+		pending := 0
+		start := func(addrs []net.IPAddr, primary bool) {
+			pending++
+			go func() {
+				conn, err := dialSerial(dialCtx, addrs)
+				results <- dialResult{conn: conn, err: err, primary: primary, family: ipFamily(addrs[0].IP)}
+			}()
+		}
+
+		fallbackStarted := false
+		startFallback := func() {
+			fallbackStarted = true
+			start(fallbacks, false)
+		}
+		if len(primaries) == 0 {
+			primaries, fallbacks = fallbacks, nil
+		}
+		start(primaries, true)
+		fallbackTimer := time.NewTimer(fallbackDelay)
+		defer fallbackTimer.Stop()
+		if len(fallbacks) == 0 {
+			fallbackTimer.Stop()
+		}
+
+		var winner dialResult
+		var errs []error
+		for winner.conn == nil && pending > 0 {
+			select {
+			case <-fallbackTimer.C:
+				if !fallbackStarted {
+					startFallback()
+				}
+			case res := <-results:
+				pending--
+				if res.err == nil {
+					winner = res
+					continue
+				}
+				errs = append(errs, res.err)
+				if res.primary && len(fallbacks) > 0 && !fallbackStarted {
+					// The primary family failed before the delay, don't wait.
+					fallbackTimer.Stop()
+					startFallback()
+				}
+			}
+		}
+
+		// Close the connections of the losers once their dials return.
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if res := <-results; res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}(pending)
+
+		if trace := bufferedClientTraceFrom(ctx); trace != nil {
+			mu.Lock()
+			values := map[string]interface{}{
+				"attempts":        append([]dialAttempt(nil), attempts...),
+				"fallbackDelay":   fallbackDelay.String(),
+				"fallbackStarted": fallbackStarted,
+			}
+			mu.Unlock()
+			if winner.conn != nil {
+				values["winner"] = winner.family
+				values["remoteAddr"] = winner.conn.RemoteAddr().String()
+			}
+			trace.add("HappyEyeballs", values)
+		}
+
+		if winner.conn == nil {
+			return nil, errors.Join(errs...)
+		}
+		return winner.conn, nil
+	}
+}
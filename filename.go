@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// fileTokens are the tokens of --filename-template.
+var fileTokens = []string{"runID", "host", "timestamp", "outcome"}
+
+var fileTokenPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// fileTemplate is the path of the files of a run without their suffix, such
+// as "-log.log", with {token}s filled in for every run.
+type fileTemplate string
+
+func (t *fileTemplate) String() string {
+	return string(*t)
+}
+
+func (t *fileTemplate) Set(value string) error {
+	if value == "" {
+		return errors.New("empty filename template")
+	}
+	for _, token := range fileTokenPattern.FindAllString(value, -1) {
+		if !slices.Contains(fileTokens, strings.Trim(token, "{}")) {
+			return fmt.Errorf("unknown token %s, must be one of {%s}", token, strings.Join(fileTokens, "}, {"))
+		}
+	}
+	if strings.ContainsAny(fileTokenPattern.ReplaceAllString(value, ""), "{}") {
+		return fmt.Errorf("unbalanced braces in filename template %q", value)
+	}
+	*t = fileTemplate(value)
+	return nil
+}
+
+// pendingOutcome is the {outcome} of the files created before the request is
+// done.
+const pendingOutcome = "pending"
+
+// runFiles names the files of one run. The files are created before the
+// outcome of the request is known, so with an {outcome} token they're created
+// as pending and moved by setOutcome.
+type runFiles struct {
+	template fileTemplate
+	values   map[string]string
+	// pending are the suffixes of the files created before setOutcome.
+	pending []string
+}
+
+func newRunFiles(template fileTemplate, runID, rawURL string, start time.Time) *runFiles {
+	host := "unknown"
+	if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return &runFiles{
+		template: template,
+		values: map[string]string{
+			"runID":     runID,
+			"host":      host,
+			"timestamp": start.UTC().Format("20060102T150405Z"),
+		},
+	}
+}
+
+func (f *runFiles) render(outcome, suffix string) string {
+	path := fileTokenPattern.ReplaceAllStringFunc(string(f.template), func(token string) string {
+		name := strings.Trim(token, "{}")
+		if name == "outcome" {
+			return outcome
+		}
+		return f.values[name]
+	})
+	return path + suffix
+}
+
+// path returns the path of the file with suffix and creates its directory.
+func (f *runFiles) path(suffix string) (string, error) {
+	outcome, ok := f.values["outcome"]
+	if !ok {
+		outcome = pendingOutcome
+		if strings.Contains(string(f.template), "{outcome}") {
+			f.pending = append(f.pending, suffix)
+		}
+	}
+	path := f.render(outcome, suffix)
+	return path, os.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// setOutcome fills in the {outcome} of the files created from now on and
+// moves those created before. Open files keep being written where they
+// moved.
+func (f *runFiles) setOutcome(outcome string) error {
+	f.values["outcome"] = outcome
+	var errs []error
+	for _, suffix := range f.pending {
+		to := f.render(outcome, suffix)
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		from := f.render(pendingOutcome, suffix)
+		if err := os.Rename(from, to); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// Only removed once empty, such as a pending directory.
+		_ = os.Remove(filepath.Dir(from))
+	}
+	f.pending = nil
+	return errors.Join(errs...)
+}
+
+// runOutcome is the {outcome} of the results of a run: ok, error,
+// http_error, or none when no request could be made.
+func runOutcome(results []*RequestResult) string {
+	if len(results) == 0 {
+		return "none"
+	}
+	last := results[len(results)-1]
+	switch {
+	case last.Error != "":
+		return "error"
+	case last.Status >= 400:
+		return "http_error"
+	}
+	return "ok"
+}
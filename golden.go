@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// goldenSlack is the difference of a phase duration tolerated whatever
+// --golden-tolerance, so sub-millisecond phases don't fail on noise.
+const goldenSlack = 10 * time.Millisecond
+
+// volatileHeaders change from one response to the next and are left out of
+// the golden, along with --correlation-header and traceparent.
+var volatileHeaders = []string{"Date", "Age", "Expires", "Last-Modified", "Set-Cookie", "Traceparent"}
+
+// exchange is what a golden records of a request beyond its result: the
+// headers of the request and the response and the body as read.
+type exchange struct {
+	RequestHeader  http.Header
+	ResponseHeader http.Header
+	BodySHA256     string
+	BodySize       int64
+}
+
+// hashingBody hashes a response body as it's read, whoever reads it.
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	size int64
+}
+
+func newHashingBody(body io.ReadCloser) *hashingBody {
+	return &hashingBody{ReadCloser: body, hash: sha256.New()}
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.size += int64(n)
+	return n, err
+}
+
+// golden is the file of --record-golden and --verify-against: the contract of
+// an endpoint, compared field by field and the durations with a tolerance.
+type golden struct {
+	SchemaVersion   int                 `json:"schemaVersion"`
+	Method          string              `json:"method"`
+	URL             string              `json:"url"`
+	Status          int                 `json:"status"`
+	Proto           string              `json:"proto"`
+	ErrorCategory   string              `json:"errorCategory"`
+	RequestHeaders  map[string][]string `json:"requestHeaders"`
+	ResponseHeaders map[string][]string `json:"responseHeaders"`
+	BodySHA256      string              `json:"bodySHA256"`
+	BodySize        int64               `json:"bodySize"`
+	DurationsMs     map[string]float64  `json:"durationsMs"`
+}
+
+// goldenHeaders returns header without the volatile headers, sensitive
+// values redacted.
+func goldenHeaders(header http.Header, ignore string) map[string][]string {
+	headers := make(map[string][]string, len(header))
+	for name, values := range header {
+		if slices.Contains(volatileHeaders, name) || name == ignore {
+			continue
+		}
+		headers[name] = redactHeader(name, values)
+	}
+	return headers
+}
+
+func (r *Runner) newGolden(result *RequestResult) *golden {
+	g := &golden{
+		SchemaVersion:   schemaVersion,
+		Method:          result.Method,
+		URL:             result.URL,
+		Status:          result.Status,
+		Proto:           result.Proto,
+		ErrorCategory:   result.ErrorCategory,
+		RequestHeaders:  map[string][]string{},
+		ResponseHeaders: map[string][]string{},
+		DurationsMs:     result.durationsMs(),
+	}
+	if x := result.Exchange; x != nil {
+		g.RequestHeaders = goldenHeaders(x.RequestHeader, r.cfg.CorrelationHdr)
+		g.ResponseHeaders = goldenHeaders(x.ResponseHeader, r.cfg.CorrelationHdr)
+		g.BodySHA256 = x.BodySHA256
+		g.BodySize = x.BodySize
+	}
+	return g
+}
+
+func loadGolden(path string) (*golden, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g golden
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &g, nil
+}
+
+func writeGolden(path string, g *golden) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// diffGolden lists how got departs from want. A phase only fails when it
+// differs by more than tolerance times its golden duration and goldenSlack;
+// phases missing on either side, such as those of a new connection once one
+// is reused, aren't compared.
+func diffGolden(want, got *golden, tolerance float64) []string {
+	var diffs []string
+	differ := func(field string, want, got interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%s: %v -> %v", field, want, got))
+	}
+	if want.Method != got.Method {
+		differ("method", want.Method, got.Method)
+	}
+	if want.URL != got.URL {
+		differ("url", want.URL, got.URL)
+	}
+	if want.Status != got.Status {
+		differ("status", want.Status, got.Status)
+	}
+	if want.Proto != got.Proto {
+		differ("proto", want.Proto, got.Proto)
+	}
+	if want.ErrorCategory != got.ErrorCategory {
+		differ("errorCategory", want.ErrorCategory, got.ErrorCategory)
+	}
+	diffs = append(diffs, diffHeaders("request header", want.RequestHeaders, got.RequestHeaders)...)
+	diffs = append(diffs, diffHeaders("response header", want.ResponseHeaders, got.ResponseHeaders)...)
+	if want.BodySHA256 != got.BodySHA256 {
+		differ("body sha256", want.BodySHA256, got.BodySHA256)
+	}
+	if want.BodySize != got.BodySize {
+		differ("body size", want.BodySize, got.BodySize)
+	}
+
+	for _, name := range append(phaseNames(), "total") {
+		w, wok := want.DurationsMs[name]
+		g, gok := got.DurationsMs[name]
+		if !wok || !gok {
+			continue
+		}
+		wd := time.Duration(w * float64(time.Millisecond))
+		gd := time.Duration(g * float64(time.Millisecond))
+		allowed := max(time.Duration(tolerance*float64(wd)), goldenSlack)
+		if d := gd - wd; d > allowed || -d > allowed {
+			differ(name, wd.Round(time.Microsecond), fmt.Sprintf("%s (tolerance %s)", gd.Round(time.Microsecond), allowed.Round(time.Microsecond)))
+		}
+	}
+	return diffs
+}
+
+func diffHeaders(kind string, want, got map[string][]string) []string {
+	names := make([]string, 0, len(want)+len(got))
+	for name := range want {
+		names = append(names, name)
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []string
+	for _, name := range names {
+		w, wok := want[name]
+		g, gok := got[name]
+		switch {
+		case !gok:
+			diffs = append(diffs, fmt.Sprintf("%s %s removed: %q", kind, name, w))
+		case !wok:
+			diffs = append(diffs, fmt.Sprintf("%s %s added: %q", kind, name, g))
+		case !slices.Equal(w, g):
+			diffs = append(diffs, fmt.Sprintf("%s %s: %q -> %q", kind, name, w, g))
+		}
+	}
+	return diffs
+}
+
+// checkGolden records result with --record-golden, or compares it with the
+// golden of --verify-against and returns the differences.
+func (r *Runner) checkGolden(result *RequestResult) []string {
+	g := r.newGolden(result)
+	if r.cfg.RecordGolden != "" {
+		if err := writeGolden(r.cfg.RecordGolden, g); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing golden:", err)
+		}
+		return nil
+	}
+	return diffGolden(r.golden, g, r.cfg.GoldenTolerance)
+}
+
+// setExchange fills in the exchange of result once its body was read.
+func setExchange(result *RequestResult, req *http.Request, resp *http.Response, body *hashingBody) {
+	result.Exchange = &exchange{
+		RequestHeader:  req.Header,
+		ResponseHeader: resp.Header,
+		BodySHA256:     hex.EncodeToString(body.hash.Sum(nil)),
+		BodySize:       body.size,
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time          `json:"startedDateTime"`
+	Time            float64            `json:"time"`
+	Request         harRequest         `json:"request"`
+	Response        harResponse        `json:"response"`
+	Cache           struct{}           `json:"cache"`
+	Timings         map[string]float64 `json:"timings"`
+	ServerIPAddress string             `json:"serverIPAddress,omitempty"`
+	Comment         string             `json:"comment,omitempty"`
+	Stages          []Stage            `json:"_stages"`
+}
+
+type harRequest struct {
+	Method      string        `json:"method"`
+	URL         string        `json:"url"`
+	HTTPVersion string        `json:"httpVersion"`
+	Cookies     []interface{} `json:"cookies"`
+	Headers     []interface{} `json:"headers"`
+	QueryString []interface{} `json:"queryString"`
+	HeadersSize int           `json:"headersSize"`
+	BodySize    int           `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int           `json:"status"`
+	StatusText  string        `json:"statusText"`
+	HTTPVersion string        `json:"httpVersion"`
+	Cookies     []interface{} `json:"cookies"`
+	Headers     []interface{} `json:"headers"`
+	Content     struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+	} `json:"content"`
+	RedirectURL string `json:"redirectURL"`
+	HeadersSize int    `json:"headersSize"`
+	BodySize    int    `json:"bodySize"`
+}
+
+// HARExporter writes every request to the <run>.har file of
+// --filename-template, or <run>-stepN.har for a step of --sequence.
+type HARExporter struct {
+	filePath func(suffix string) (string, error)
+}
+
+// harTimings maps the phases onto the HAR timings, -1 meaning not applicable.
+func harTimings(result *RequestResult) map[string]float64 {
+	ms := result.durationsMs()
+	timing := func(name string) float64 {
+		if d, ok := ms[name]; ok {
+			return d
+		}
+		return -1
+	}
+
+	timings := map[string]float64{
+		"blocked": -1,
+		"dns":     timing("dns"),
+		"connect": timing("connect"),
+		"ssl":     timing("tls"),
+		"send":    0,
+		"wait":    timing("ttfb"),
+		"receive": 0,
+	}
+	if timings["wait"] < 0 {
+		timings["wait"] = 0
+	}
+	if end, ok := findStage(result.Stages, "GotFirstResponseByte"); ok && len(result.Stages) > 0 {
+		last := result.Stages[len(result.Stages)-1]
+		timings["receive"] = float64(last.Time.Sub(end.Time)) / float64(time.Millisecond)
+	}
+
+	return timings
+}
+
+func (e *HARExporter) Export(runID string, result *RequestResult) error {
+	har := harLog{}
+	har.Log.Version = "1.2"
+	har.Log.Creator = harCreator{Name: "dump-pcap", Version: "1"}
+
+	entry := harEntry{
+		StartedDateTime: result.Start,
+		Time:            result.durationsMs()["total"],
+		Request: harRequest{
+			Method:      result.Method,
+			URL:         result.URL,
+			HTTPVersion: result.Proto,
+			Cookies:     []interface{}{},
+			Headers:     []interface{}{},
+			QueryString: []interface{}{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      result.Status,
+			HTTPVersion: result.Proto,
+			Cookies:     []interface{}{},
+			Headers:     []interface{}{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings:         harTimings(result),
+		ServerIPAddress: serverIP(result.RemoteAddr),
+		Comment:         result.Error,
+		Stages:          result.Stages,
+	}
+	har.Log.Entries = []harEntry{entry}
+
+	path, err := e.filePath(stepSuffix(result, ".har"))
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(path, har)
+}
+
+// serverIP is the IP of addr, as HAR has no place for the port.
+func serverIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (e *HARExporter) Close() error {
+	return nil
+}
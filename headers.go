@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// headerList collects repeated -H "Key: Value" flags.
+type headerList []string
+
+func (l *headerList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *headerList) Set(value string) error {
+	if _, _, ok := splitHeaderLine(value); !ok {
+		return fmt.Errorf("invalid header %q, want \"Key: Value\"", value)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// headerNames is a comma-separated list of header names.
+type headerNames []string
+
+func (l *headerNames) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *headerNames) Set(value string) error {
+	*l = nil
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		*l = append(*l, http.CanonicalHeaderKey(name))
+	}
+	return nil
+}
+
+func splitHeaderLine(line string) (string, string, bool) {
+	key, value, ok := strings.Cut(line, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(value), true
+}
+
+var requestLinePattern = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/\d`)
+
+// readHeadersFile reads "Key: Value" lines as copied from a browser or an
+// HTTP message. A leading request line, blank lines and # comments are
+// skipped.
+func readHeadersFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || (n == 1 && requestLinePattern.MatchString(line)) {
+			continue
+		}
+		if _, _, ok := splitHeaderLine(line); !ok {
+			return nil, fmt.Errorf("%s:%d: invalid header %q", path, n, line)
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// addHeaders adds the header lines to req, appending to duplicate keys. A
+// Host header sets req.Host.
+func addHeaders(req *http.Request, lines []string) {
+	for _, line := range lines {
+		key, value, _ := splitHeaderLine(line)
+		if http.CanonicalHeaderKey(key) == "Host" {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(key, value)
+	}
+}
+
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Auth-Token":        true,
+}
+
+func redactHeader(key string, values []string) []string {
+	if !sensitiveHeaders[http.CanonicalHeaderKey(key)] {
+		return values
+	}
+	redacted := make([]string, len(values))
+	for i := range values {
+		redacted[i] = "[REDACTED]"
+	}
+	return redacted
+}
+
+// selectHeaders returns the values of the headers of names that are present,
+// with sensitive ones redacted.
+func selectHeaders(header http.Header, names []string) map[string]interface{} {
+	values := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if v := header.Values(name); len(v) > 0 {
+			values[name] = redactHeader(name, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultBuckets are the upper bounds of the phase duration histograms, those
+// of the Prometheus clients.
+var defaultBuckets = histogramBuckets{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second,
+}
+
+// histogramBuckets are the upper bounds of --histogram-buckets, given in ms,
+// ascending.
+type histogramBuckets []time.Duration
+
+func (b *histogramBuckets) String() string {
+	bounds := make([]string, 0, len(*b))
+	for _, d := range *b {
+		bounds = append(bounds, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64))
+	}
+	return strings.Join(bounds, ",")
+}
+
+func (b *histogramBuckets) Set(value string) error {
+	var buckets histogramBuckets
+	for _, bound := range strings.Split(value, ",") {
+		ms, err := strconv.ParseFloat(strings.TrimSpace(bound), 64)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("invalid bucket %q, want a number of ms", bound)
+		}
+		d := time.Duration(ms * float64(time.Millisecond))
+		if len(buckets) > 0 && d <= buckets[len(buckets)-1] {
+			return errors.New("buckets must be ascending")
+		}
+		buckets = append(buckets, d)
+	}
+	*b = buckets
+	return nil
+}
+
+// histogram counts durations into buckets, the last one for those above
+// every bound.
+type histogram struct {
+	counts []uint64
+	sum    time.Duration
+	count  uint64
+}
+
+func (h *histogram) observe(buckets histogramBuckets, d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets)+1)
+	}
+	i := 0
+	for i < len(buckets) && d > buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += d
+	h.count++
+}
+
+// write writes h in the Prometheus text format, its buckets cumulative.
+func (h *histogram) write(w io.Writer, name, phase string, buckets histogramBuckets) {
+	var cumulative uint64
+	for i, bound := range buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"%g\"} %d\n", name, phase, bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"+Inf\"} %d\n", name, phase, h.count)
+	fmt.Fprintf(w, "%s_sum{phase=%q} %g\n", name, phase, h.sum.Seconds())
+	fmt.Fprintf(w, "%s_count{phase=%q} %d\n", name, phase, h.count)
+}
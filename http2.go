@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// tracingConnPool wraps the HTTP/2 connection pool to record which
+// connection a request got and how busy it was. Stream IDs aren't exposed by
+// the transport, so they can't be recorded.
+type tracingConnPool struct {
+	http2.ClientConnPool
+
+	mu sync.Mutex
+	// used are the connections requests got so far, until they're closed.
+	used map[*http2.ClientConn]bool
+}
+
+func (p *tracingConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	cc, err := p.ClientConnPool.GetClientConn(req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	previouslyUsed := p.used[cc]
+	p.used[cc] = true
+	p.mu.Unlock()
+
+	if trace := bufferedClientTraceFrom(req.Context()); trace != nil {
+		state := cc.State()
+		trace.http2Conn.Store(&state)
+		trace.add("HTTP2Conn", map[string]interface{}{
+			"addr":                 addr,
+			"previouslyUsed":       previouslyUsed,
+			"multiplexed":          state.StreamsActive > 0,
+			"streamsActive":        state.StreamsActive,
+			"streamsPending":       state.StreamsPending,
+			"maxConcurrentStreams": state.MaxConcurrentStreams,
+		})
+	}
+
+	return cc, nil
+}
+
+func (p *tracingConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	delete(p.used, cc)
+	p.mu.Unlock()
+	p.ClientConnPool.MarkDead(cc)
+}
+
+// CloseIdleConnections closes the connections without streams. The wrapper
+// hides the unexported method the transport closes idle connections with, so
+// http.Transport.CloseIdleConnections leaves the HTTP/2 ones open.
+func (p *tracingConnPool) CloseIdleConnections() {
+	var idle []*http2.ClientConn
+	p.mu.Lock()
+	for cc := range p.used {
+		state := cc.State()
+		if state.Closed {
+			delete(p.used, cc)
+		} else if state.StreamsActive == 0 && state.StreamsReserved == 0 && state.StreamsPending == 0 {
+			idle = append(idle, cc)
+			delete(p.used, cc)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, cc := range idle {
+		cc.Close()
+	}
+}
+
+// configureHTTP2 enables HTTP/2 on t through golang.org/x/net/http2 so the
+// connection pool can be traced, and returns the pool.
+func configureHTTP2(t *http.Transport) (*tracingConnPool, error) {
+	t2, err := http2.ConfigureTransports(t)
+	if err != nil {
+		return nil, err
+	}
+	pool := &tracingConnPool{
+		ClientConnPool: t2.ConnPool,
+		used:           make(map[*http2.ClientConn]bool),
+	}
+	t2.ConnPool = pool
+
+	return pool, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// TestTracingConnPoolCloseIdle checks that the idle HTTP/2 connections are
+// closed through the wrapper, which the transport can't do by itself, and
+// forgotten once closed.
+func TestTracingConnPoolCloseIdle(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	pool, err := configureHTTP2(transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+
+	var conns []*http2.ClientConn
+	for i := 0; i < 2; i++ {
+		trace := NewBufferedClientTrace(nil)
+		req, err := http.NewRequestWithContext(withBufferedClientTrace(context.Background(), trace), http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("proto %s, want HTTP/2", resp.Proto)
+		}
+
+		stage, ok := findStage(trace.Finish(), "HTTP2Conn")
+		if !ok {
+			t.Fatal("no HTTP2Conn stage")
+		}
+		if got, want := stage.Values["previouslyUsed"], i > 0; got != want {
+			t.Errorf("request %d: previouslyUsed = %v, want %v", i, got, want)
+		}
+		if stage.Values["multiplexed"] != false {
+			t.Errorf("request %d: multiplexed without a concurrent stream", i)
+		}
+	}
+	pool.mu.Lock()
+	for cc := range pool.used {
+		conns = append(conns, cc)
+	}
+	pool.mu.Unlock()
+	if len(conns) != 1 {
+		t.Fatalf("%d connections used, want 1", len(conns))
+	}
+
+	pool.CloseIdleConnections()
+	if !conns[0].State().Closed {
+		t.Error("idle HTTP/2 connection left open")
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.used) != 0 {
+		t.Errorf("%d closed connections kept", len(pool.used))
+	}
+}
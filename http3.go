@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Transport is the transport of --http3 with the UDP socket its QUIC
+// connections share, which the HTTP/3 transport doesn't close itself.
+type http3Transport struct {
+	*http3.Transport
+	quic *quic.Transport
+}
+
+func (t *http3Transport) Close() error {
+	return errors.Join(t.Transport.Close(), t.quic.Close())
+}
+
+// newHTTP3Client returns a client that does the requests over QUIC with
+// tlsConfig, its ALPN replaced with h3.
+func (r *Runner) newHTTP3Client(tlsConfig *tls.Config) (*http.Client, error) {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening UDP socket: %w", err)
+	}
+	resolver := net.DefaultResolver
+	if r.cfg.TraceDNSServers || r.cfg.DNSQueries {
+		resolver = tracingResolver()
+	}
+	qt := &quic.Transport{Conn: udpConn}
+
+	return &http.Client{
+		Transport: &http3Transport{
+			Transport: &http3.Transport{
+				TLSClientConfig: tlsConfig,
+				QUICConfig: &quic.Config{
+					HandshakeIdleTimeout: r.cfg.ConnectTimeout,
+					MaxIdleTimeout:       r.cfg.IdleConnTimeout,
+				},
+				Dial: quicDial(qt, resolver, r.cfg.TLSEarlyData),
+			},
+			quic: qt,
+		},
+		Timeout: 10 * time.Second,
+	}, nil
+}
+
+// quicDial dials QUIC connections from qt. It records the same stages as a
+// TCP connection, so the phases line up: the lookup fires DNSStart and
+// DNSDone, and since QUIC connects and does the TLS handshake at once,
+// ConnectStart and ConnectDone enclose TLSHandshakeStart and
+// TLSHandshakeDone around the QUIC handshake. A QUICConnection stage follows
+// with what's specific to QUIC. With earlyData, a resumed connection is
+// returned before its handshake is done, for the request to go as 0-RTT,
+// and the stages of the handshake are recorded once it is, TLSHandshakeDone
+// with whether the server accepted the early data.
+func quicDial(qt *quic.Transport, resolver *net.Resolver, earlyData bool) func(context.Context, string, *tls.Config, *quic.Config) (*quic.Conn, error) {
+	return func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		portNum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+		if err != nil {
+			return nil, err
+		}
+		udpAddr := &net.UDPAddr{IP: ips[0].IP, Port: portNum, Zone: ips[0].Zone}
+
+		trace := httptrace.ContextClientTrace(ctx)
+		bt := bufferedClientTraceFrom(ctx)
+		if trace != nil {
+			trace.ConnectStart("udp", udpAddr.String())
+			trace.TLSHandshakeStart()
+		}
+		conn, err := qt.DialEarly(ctx, udpAddr, tlsCfg, cfg)
+		handshakeDone := func(err error) {
+			var state quic.ConnectionState
+			if conn != nil {
+				state = conn.ConnectionState()
+			}
+			if bt != nil && earlyData {
+				bt.earlyData.Store(true)
+				bt.earlyDataAccepted.Store(state.Used0RTT)
+			}
+			if trace != nil {
+				trace.TLSHandshakeDone(state.TLS, err)
+				trace.ConnectDone("udp", udpAddr.String(), err)
+			}
+			if bt != nil && err == nil {
+				bt.add("QUICConnection", map[string]interface{}{
+					"version":           state.Version.String(),
+					"used0RTT":          state.Used0RTT,
+					"supportsDatagrams": state.SupportsDatagrams,
+					"gso":               state.GSO,
+					"localAddr":         conn.LocalAddr().String(),
+					"remoteAddr":        conn.RemoteAddr().String(),
+				})
+			}
+		}
+		if err != nil {
+			handshakeDone(err)
+			return nil, err
+		}
+
+		select {
+		case <-conn.HandshakeComplete():
+			handshakeDone(nil)
+		default:
+			// Only 0-RTT returns the connection this early.
+			go func() {
+				select {
+				case <-conn.HandshakeComplete():
+					handshakeDone(nil)
+				case <-conn.Context().Done():
+					handshakeDone(context.Cause(conn.Context()))
+				}
+			}()
+		}
+		return conn, nil
+	}
+}
+
+// earlyDataRequest returns req to be sent as 0-RTT early data by the HTTP/3
+// transport, for --tls-early-data. Only GET and HEAD, which are safe to
+// replay, can be.
+func earlyDataRequest(req *http.Request) *http.Request {
+	early := *req
+	switch req.Method {
+	case http.MethodGet:
+		early.Method = http3.MethodGet0RTT
+	case http.MethodHead:
+		early.Method = http3.MethodHead0RTT
+	default:
+		return req
+	}
+	return &early
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// TestHTTP3EarlyData resumes a QUIC connection with 0-RTT, as
+// --tls-early-data does, and checks TLSHandshakeDone records whether the
+// server accepted the early data.
+func TestHTTP3EarlyData(t *testing.T) {
+	// The certificate of httptest, for 127.0.0.1.
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certServer.Close()
+	roots := certServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{
+		TLSConfig:  http3.ConfigureTLSConfig(&tls.Config{Certificates: certServer.TLS.Certificates}),
+		QUICConfig: &quic.Config{Allow0RTT: true},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Method)
+		}),
+	}
+	go server.Serve(udpConn)
+	defer server.Close()
+
+	tlsConfig := &tls.Config{
+		RootCAs:            roots,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	for i, wantAccepted := range []bool{false, true} {
+		clientConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qt := &quic.Transport{Conn: clientConn}
+		transport := &http3Transport{
+			Transport: &http3.Transport{
+				TLSClientConfig: tlsConfig,
+				Dial:            quicDial(qt, net.DefaultResolver, true),
+			},
+			quic: qt,
+		}
+
+		trace := NewBufferedClientTrace(nil)
+		req, err := http.NewRequestWithContext(withBufferedClientTrace(context.Background(), trace), http.MethodGet, "https://"+udpConn.LocalAddr().String()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: transport}).Do(earlyDataRequest(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != http.MethodGet {
+			t.Errorf("request %d: server got %q, want GET", i, body)
+		}
+		// The handshake of an early connection is recorded once it's done,
+		// from a goroutine of its own.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, ok := findStage(trace.snapshot(), "TLSHandshakeDone"); ok || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		transport.Close()
+		stages := trace.Finish()
+
+		stage, ok := findStage(stages, "TLSHandshakeDone")
+		if !ok {
+			t.Fatalf("request %d: no TLSHandshakeDone in %v", i, stages)
+		}
+		if got := stage.Values["earlyDataAccepted"]; got != wantAccepted {
+			t.Errorf("request %d: earlyDataAccepted = %v, want %v", i, got, wantAccepted)
+		}
+		if stage.Values["didResume"] != (i > 0) {
+			t.Errorf("request %d: didResume = %v", i, stage.Values["didResume"])
+		}
+	}
+}
+
+func TestEarlyDataRequest(t *testing.T) {
+	for method, want := range map[string]string{
+		http.MethodGet:  http3.MethodGet0RTT,
+		http.MethodHead: http3.MethodHead0RTT,
+		http.MethodPost: http.MethodPost,
+	} {
+		req := httptest.NewRequest(method, "https://example.com/", nil)
+		if got := earlyDataRequest(req).Method; got != want {
+			t.Errorf("%s sent as %s, want %s", method, got, want)
+		}
+		if req.Method != method {
+			t.Errorf("%s request changed to %s", method, req.Method)
+		}
+	}
+}
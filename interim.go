@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRecentFailures bounds the failures kept between two interim reports.
+const maxRecentFailures = 20
+
+// recentFailure is a failed request of an interim report.
+type recentFailure struct {
+	RunID         string    `json:"runID"`
+	Time          time.Time `json:"time"`
+	Status        int       `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	ErrorCategory string    `json:"errorCategory,omitempty"`
+}
+
+// interimReport is the state of a long run every --report-interval: the
+// totals since the start and the failures since the previous report.
+type interimReport struct {
+	Time            time.Time                    `json:"time"`
+	Elapsed         string                       `json:"elapsed"`
+	Requests        int                          `json:"requests"`
+	Failures        int                          `json:"failures"`
+	ErrorCategories map[string]int               `json:"errorCategories"`
+	Connections     int                          `json:"connections"`
+	ReusedConns     int                          `json:"reusedConnections"`
+	Phases          map[string]map[string]string `json:"phases"`
+	RecentFailures  []recentFailure              `json:"recentFailures"`
+	// DroppedFailures are the failures since the previous report beyond
+	// those listed.
+	DroppedFailures int `json:"droppedFailures"`
+}
+
+// observeResult counts the request of runID for the interim reports, ok
+// telling whether it succeeded.
+func (m *Metrics) observeResult(runID string, result *RequestResult, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if ok {
+		return
+	}
+	m.failures++
+	if result.ErrorCategory != "" {
+		m.categories[result.ErrorCategory]++
+	}
+	if len(m.recentFailures) == maxRecentFailures {
+		m.droppedFailures++
+		return
+	}
+	m.recentFailures = append(m.recentFailures, recentFailure{
+		RunID:         runID,
+		Time:          result.Start,
+		Status:        result.Status,
+		Error:         result.Error,
+		ErrorCategory: result.ErrorCategory,
+	})
+}
+
+// interimReport takes a snapshot of the metrics under their lock, so the
+// report doesn't race the requests going on, and starts over the recent
+// failures.
+func (m *Metrics) interimReport(start time.Time) *interimReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	report := &interimReport{
+		Time:            now,
+		Elapsed:         now.Sub(start).Round(time.Second).String(),
+		Requests:        m.requests,
+		Failures:        m.failures,
+		ErrorCategories: make(map[string]int, len(m.categories)),
+		Connections:     m.conns,
+		ReusedConns:     m.reusedConns,
+		Phases:          make(map[string]map[string]string, len(m.samples)),
+		RecentFailures:  append([]recentFailure{}, m.recentFailures...),
+		DroppedFailures: m.droppedFailures,
+	}
+	for category, n := range m.categories {
+		report.ErrorCategories[category] = n
+	}
+	for phase, samples := range m.samples {
+		sorted := slices.Clone(samples)
+		slices.Sort(sorted)
+		stats := map[string]string{}
+		for _, p := range []float64{50, 95, 99} {
+			stats[fmt.Sprintf("p%g", p)] = percentile(sorted, p).Round(time.Microsecond).String()
+		}
+		report.Phases[phase] = stats
+	}
+	m.recentFailures = nil
+	m.droppedFailures = 0
+	return report
+}
+
+// summary is report in a line for stdout.
+func (report *interimReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "after %s: %d requests, %d failed", report.Elapsed, report.Requests, report.Failures)
+	if len(report.ErrorCategories) > 0 {
+		categories := make([]string, 0, len(report.ErrorCategories))
+		for category, n := range report.ErrorCategories {
+			categories = append(categories, fmt.Sprintf("%s %d", category, n))
+		}
+		sort.Strings(categories)
+		fmt.Fprintf(&b, " (%s)", strings.Join(categories, ", "))
+	}
+	if stats, ok := report.Phases["total"]; ok {
+		fmt.Fprintf(&b, ", total p50 %s p95 %s p99 %s", stats["p50"], stats["p95"], stats["p99"])
+	}
+	return b.String()
+}
+
+// startReports writes an interim report every --report-interval until the
+// returned func is called: a line on stdout, a JSON line appended to
+// out/reports.ndjson and, when the logs outlive a run, an "Interim report"
+// entry. With --report-roll the --log-file is then moved aside, suffixed
+// with the time, and a new one started.
+func (r *Runner) startReports(start time.Time) func() {
+	f, err := os.OpenFile("out/reports.ndjson", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the interim reports:", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(r.cfg.ReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.writeReport(r.metrics.interimReport(start), f)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func (r *Runner) writeReport(report *interimReport, f *os.File) {
+	r.summary("interim report", report.summary())
+	if f != nil {
+		if err := json.NewEncoder(f).Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing the interim report:", err)
+		}
+	}
+	if r.cfg.LogFile == "" && !r.cfg.Syslog {
+		// The log of the run going on isn't the place.
+		return
+	}
+	r.logger.WithField("report", report).Info("Interim report")
+	if r.cfg.ReportRoll {
+		rolled := r.cfg.LogFile + "." + report.Time.UTC().Format("20060102T150405.000Z")
+		if err := os.Rename(r.cfg.LogFile, rolled); err != nil {
+			fmt.Fprintln(os.Stderr, "Error rolling the log file:", err)
+			return
+		}
+		if err := r.reopenLog(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reopening log file:", err)
+		}
+	}
+}
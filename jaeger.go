@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Types and tag value types of the Thrift binary protocol and jaeger.thrift.
+const (
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftDouble = 4
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftList   = 15
+
+	jaegerTagString = 0
+	jaegerTagDouble = 1
+	jaegerTagBool   = 2
+	jaegerTagLong   = 3
+)
+
+// thriftWriter writes the Thrift binary protocol, only what a jaeger.thrift
+// Batch needs.
+type thriftWriter struct {
+	bytes.Buffer
+}
+
+func (w *thriftWriter) field(typ byte, id int16) {
+	w.WriteByte(typ)
+	_ = binary.Write(w, binary.BigEndian, id)
+}
+
+func (w *thriftWriter) i32(v int32) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *thriftWriter) i64(v int64) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *thriftWriter) string(s string) {
+	w.i32(int32(len(s)))
+	w.WriteString(s)
+}
+
+func (w *thriftWriter) list(elem byte, n int) {
+	w.WriteByte(elem)
+	w.i32(int32(n))
+}
+
+func (w *thriftWriter) stop() {
+	w.WriteByte(thriftStop)
+}
+
+// tag writes a jaeger.thrift Tag of value.
+func (w *thriftWriter) tag(key string, value interface{}) {
+	w.field(thriftString, 1)
+	w.string(key)
+	switch value := value.(type) {
+	case bool:
+		w.field(thriftI32, 2)
+		w.i32(jaegerTagBool)
+		w.field(thriftBool, 5)
+		if value {
+			w.WriteByte(1)
+		} else {
+			w.WriteByte(0)
+		}
+	case int:
+		w.field(thriftI32, 2)
+		w.i32(jaegerTagLong)
+		w.field(thriftI64, 6)
+		w.i64(int64(value))
+	case float64:
+		w.field(thriftI32, 2)
+		w.i32(jaegerTagDouble)
+		w.field(thriftDouble, 4)
+		w.i64(int64(math.Float64bits(value)))
+	default:
+		w.field(thriftI32, 2)
+		w.i32(jaegerTagString)
+		w.field(thriftString, 3)
+		w.string(fmt.Sprint(value))
+	}
+	w.stop()
+}
+
+func (w *thriftWriter) tags(id int16, tags map[string]interface{}) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w.field(thriftList, id)
+	w.list(thriftStruct, len(keys))
+	for _, key := range keys {
+		w.tag(key, tags[key])
+	}
+}
+
+// hexID parses a hex trace or span ID of buildSpans, 0 when there is none.
+func hexID(s string) int64 {
+	id, _ := strconv.ParseUint(s, 16, 64)
+	return int64(id)
+}
+
+// jaegerBatch encodes spans as a jaeger.thrift Batch of the dump-pcap
+// process, each span tagged with tags besides its attributes.
+func jaegerBatch(spans []Span, tags map[string]interface{}) []byte {
+	var w thriftWriter
+	w.field(thriftStruct, 1) // process
+	w.field(thriftString, 1)
+	w.string("dump-pcap")
+	w.stop()
+
+	w.field(thriftList, 2)
+	w.list(thriftStruct, len(spans))
+	for _, span := range spans {
+		// IDs are 128-bit traces and 64-bit spans in hex.
+		traceHigh, traceLow := "", span.TraceID
+		if len(span.TraceID) > 16 {
+			traceHigh, traceLow = span.TraceID[:len(span.TraceID)-16], span.TraceID[len(span.TraceID)-16:]
+		}
+		w.field(thriftI64, 1)
+		w.i64(hexID(traceLow))
+		w.field(thriftI64, 2)
+		w.i64(hexID(traceHigh))
+		w.field(thriftI64, 3)
+		w.i64(hexID(span.SpanID))
+		w.field(thriftI64, 4)
+		w.i64(hexID(span.ParentID))
+		w.field(thriftString, 5)
+		w.string(span.Name)
+		w.field(thriftI32, 7)
+		w.i32(1) // sampled
+		w.field(thriftI64, 8)
+		w.i64(span.Start.UnixMicro())
+		w.field(thriftI64, 9)
+		w.i64(span.End.Sub(span.Start).Microseconds())
+
+		spanTags := make(map[string]interface{}, len(span.Attributes)+len(tags)+2)
+		for key, value := range span.Attributes {
+			spanTags[key] = value
+		}
+		for key, value := range tags {
+			spanTags[key] = value
+		}
+		spanTags["span.kind"] = "client"
+		if span.Error != "" {
+			spanTags["error"] = true
+			spanTags["error.message"] = span.Error
+		}
+		w.tags(10, spanTags)
+		w.stop()
+	}
+	w.stop()
+	return w.Bytes()
+}
+
+// JaegerExporter sends every request as the spans of the otlp output format
+// to the HTTP endpoint of a Jaeger collector, in its native Thrift encoding.
+// Every span is tagged with the URL host, the method and the outcome of the
+// request.
+type JaegerExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewJaegerExporter(endpoint string) *JaegerExporter {
+	return &JaegerExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *JaegerExporter) Export(runID string, result *RequestResult) error {
+	host := ""
+	if u, err := url.Parse(result.URL); err == nil {
+		host = u.Host
+	}
+	body := jaegerBatch(buildSpans(runID, result), map[string]interface{}{
+		"host":    host,
+		"method":  result.Method,
+		"outcome": runOutcome([]*RequestResult{result}),
+	})
+
+	resp, err := e.client.Post(e.endpoint, "application/x-thrift", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("jaeger collector returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (e *JaegerExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// KafkaExporter publishes every result as a JSON message keyed by the host
+// of the request. Messages are batched and sent in the background, so an
+// unavailable broker only logs warnings instead of stalling the loop.
+type KafkaExporter struct {
+	w *kafka.Writer
+}
+
+func NewKafkaExporter(brokers, topic string, logger *logrus.Logger) (*KafkaExporter, error) {
+	if brokers == "" {
+		return nil, errors.New("--kafka-brokers is required")
+	}
+
+	return &KafkaExporter{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: time.Second,
+			MaxAttempts:  3,
+			Async:        true,
+			Completion: func(messages []kafka.Message, err error) {
+				if err != nil {
+					logger.WithError(err).WithField("messages", len(messages)).Warn("Error publishing results to Kafka")
+				}
+			},
+		},
+	}, nil
+}
+
+func (e *KafkaExporter) Export(runID string, result *RequestResult) error {
+	value, err := json.Marshal(result.record(runID))
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	if u, err := url.Parse(result.URL); err == nil {
+		key = []byte(u.Host)
+	}
+	return e.w.WriteMessages(context.Background(), kafka.Message{
+		Key:   key,
+		Value: value,
+	})
+}
+
+// Close flushes the pending batch.
+func (e *KafkaExporter) Close() error {
+	return e.w.Close()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lokiStream is a stream of the Loki push API: its labels and its
+// [timestamp in ns, line] entries.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// LokiExporter pushes every result to Loki as a stream of its own, labeled
+// with the host, outcome and run ID, of a JSON line per stage at the time of
+// the stage followed by the result without its stages. As with
+// elasticsearch, streams are buffered and pushed every flush interval in the
+// background and on exit, an unavailable Loki only printing warnings to
+// stderr and losing the streams of the failed push.
+type LokiExporter struct {
+	pushURL string
+	client  *http.Client
+
+	mu      sync.Mutex
+	pending []lokiStream
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewLokiExporter(lokiURL string, interval time.Duration) (*LokiExporter, error) {
+	if lokiURL == "" {
+		return nil, errors.New("--loki-url is required")
+	}
+	if interval <= 0 {
+		return nil, errors.New("--loki-flush-interval must be positive")
+	}
+
+	e := &LokiExporter{
+		pushURL: strings.TrimSuffix(lokiURL, "/") + "/loki/api/v1/push",
+		client:  &http.Client{Timeout: 10 * time.Second},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.run(interval)
+
+	return e, nil
+}
+
+func lokiTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *LokiExporter) Export(runID string, result *RequestResult) error {
+	host := ""
+	if u, err := url.Parse(result.URL); err == nil {
+		host = u.Host
+	}
+	stream := lokiStream{
+		Stream: map[string]string{
+			"job":     "dump-pcap",
+			"host":    host,
+			"outcome": runOutcome([]*RequestResult{result}),
+			"runID":   runID,
+		},
+	}
+
+	// Loki wants the entries of a stream in time order.
+	stages := append([]Stage(nil), result.Stages...)
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stages[i].Time.Before(stages[j].Time)
+	})
+	for i, stage := range stages {
+		line, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": schemaVersion,
+			"seq":           i,
+			"stage":         stage.Name,
+			"values":        stage.Values,
+		})
+		if err != nil {
+			return err
+		}
+		stream.Values = append(stream.Values, [2]string{lokiTimestamp(stage.Time), string(line)})
+	}
+
+	record := result.record(runID)
+	delete(record, "stages")
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	end := result.Start
+	if len(stages) > 0 {
+		end = stages[len(stages)-1].Time
+	}
+	stream.Values = append(stream.Values, [2]string{lokiTimestamp(end), string(line)})
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(e.pending, stream)
+	return nil
+}
+
+func (e *LokiExporter) run(interval time.Duration) {
+	defer close(e.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-e.stop:
+			e.flush()
+			return
+		}
+	}
+}
+
+// flush pushes the pending streams in one request.
+func (e *LokiExporter) flush() {
+	e.mu.Lock()
+	streams := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(streams) == 0 {
+		return
+	}
+
+	if err := e.push(streams); err != nil {
+		fmt.Fprintf(os.Stderr, "Error pushing %d results to Loki: %v\n", len(streams), err)
+	}
+}
+
+func (e *LokiExporter) push(streams []lokiStream) error {
+	body, err := json.Marshal(map[string]interface{}{"streams": streams})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.pushURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// Loki explains rejections, e.g. entries too old, in the body.
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("loki returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Close pushes the pending streams.
+func (e *LokiExporter) Close() error {
+	close(e.stop)
+	<-e.done
+	return nil
+}
@@ -1,132 +1,31 @@
+//go:build !traceonly
+
 package main
 
 import (
-	"context"
-	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
-	"io"
+	"github.com/sirupsen/logrus"
 	"log"
-	"net/http"
-	"net/http/httptrace"
-	"net/textproto"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
-type Stage struct {
-	Name   string                 `json:"Name"`
-	Time   time.Time              `json:"Time"`
-	Values map[string]interface{} `json:"Values"`
-}
-
-type BufferedClientTrace struct {
-	httptrace.ClientTrace
-	stages []Stage
-}
-
-func newStage(name string, values map[string]interface{}) Stage {
-	return Stage{
-		Name:   name,
-		Time:   time.Now(),
-		Values: values,
-	}
-}
-
-func NewBufferedClientTrace() *BufferedClientTrace {
-	trace := &BufferedClientTrace{
-		stages: make([]Stage, 0, 16),
-	}
-
-	trace.ClientTrace = httptrace.ClientTrace{
-		GetConn: func(hostPort string) {
-			trace.stages = append(trace.stages, newStage("GetConn", map[string]interface{}{
-				"hostPort": hostPort,
-			}))
-		},
-		GotConn: func(info httptrace.GotConnInfo) {
-			trace.stages = append(trace.stages, newStage("GotConn", map[string]interface{}{
-				"GotConnInfo": info,
-			}))
-		},
-		PutIdleConn: func(err error) {
-			trace.stages = append(trace.stages, newStage("PutIdleConn", map[string]interface{}{
-				"err": fmt.Sprintf("%v", err),
-			}))
-		},
-		GotFirstResponseByte: func() {
-			trace.stages = append(trace.stages, newStage("GotFirstResponseByte", map[string]interface{}{}))
-		},
-		Got100Continue: func() {
-			trace.stages = append(trace.stages, newStage("Got100Continue", map[string]interface{}{}))
-		},
-		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
-			trace.stages = append(trace.stages, newStage("Got1xxResponse", map[string]interface{}{
-				"code":   code,
-				"header": header,
-			}))
-			return nil
-		},
-		DNSStart: func(info httptrace.DNSStartInfo) {
-			trace.stages = append(trace.stages, newStage("DNSStart", map[string]interface{}{
-				"DNSStartInfo": info,
-			}))
-		},
-		DNSDone: func(info httptrace.DNSDoneInfo) {
-			trace.stages = append(trace.stages, newStage("DNSDone", map[string]interface{}{
-				"DNSDoneInfo": info,
-			}))
-		},
-		ConnectStart: func(network, addr string) {
-			trace.stages = append(trace.stages, newStage("ConnectStart", map[string]interface{}{
-				"network": network,
-				"addr":    addr,
-			}))
-		},
-		ConnectDone: func(network, addr string, err error) {
-			trace.stages = append(trace.stages, newStage("ConnectDone", map[string]interface{}{
-				"network": network,
-				"addr":    addr,
-				"error":   err,
-			}))
-		},
-		TLSHandshakeStart: func() {
-			trace.stages = append(trace.stages, newStage("TLSHandshakeStart", map[string]interface{}{}))
-		},
-		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
-			trace.stages = append(trace.stages, newStage("TLSHandshakeDone", map[string]interface{}{
-				"state": state,
-				"error": err,
-			}))
-		},
-		WroteHeaderField: func(key string, value []string) {
-			trace.stages = append(trace.stages, newStage("WriteHeaderField", map[string]interface{}{
-				"key":   key,
-				"value": value,
-			}))
-		},
-		WroteHeaders: func() {
-			trace.stages = append(trace.stages, newStage("WriteHeaders", map[string]interface{}{}))
-		},
-		Wait100Continue: func() {
-			trace.stages = append(trace.stages, newStage("Wait100Continue", map[string]interface{}{}))
-		},
-		WroteRequest: func(info httptrace.WroteRequestInfo) {
-			trace.stages = append(trace.stages, newStage("WroteRequest", map[string]interface{}{
-				"WroteRequestInfo": info,
-			}))
-		},
-	}
-
-	return trace
-}
-
-func capture(handle *pcap.Handle, out *os.File) {
+// capture writes the packets of handle to a pcap file, with the nanosecond
+// magic for --ts-precision=nano.
+func capture(handle *pcap.Handle, out *os.File, precision tsPrecision) {
 	w := pcapgo.NewWriter(out)
+	if precision == "nano" {
+		w = pcapgo.NewWriterNanos(out)
+	}
 	if err := w.WriteFileHeader(uint32(1600), handle.LinkType()); err != nil { // Use the same snapshot length and link type as the capture handle
 		log.Fatal(err)
 	}
@@ -139,104 +38,335 @@ func capture(handle *pcap.Handle, out *os.File) {
 	}
 }
 
-func doRequest(logger *logrus.Logger, keyLogWriter io.Writer) bool {
-	tlsConfig := tls.Config{
-		KeyLogWriter: keyLogWriter,
-	}
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy:                  http.ProxyFromEnvironment,
-			OnProxyConnectResponse: nil,
-			TLSClientConfig:        &tlsConfig,
-			TLSHandshakeTimeout:    10 * time.Second,
-			IdleConnTimeout:        10 * time.Second,
-			ResponseHeaderTimeout:  10 * time.Second,
-			ExpectContinueTimeout:  10 * time.Second,
-		},
-		Timeout: 10 * time.Second,
-	}
-
-	trace := NewBufferedClientTrace()
-	req, err := http.NewRequestWithContext(
-		httptrace.WithClientTrace(context.Background(), &trace.ClientTrace),
-		"GET",
-		"https://update.traefik.io/repos/traefik/traefik/releases",
-		nil)
-	if err != nil {
-		logger.WithError(err).Error("Error creating request")
-		return false
+// mergeWindow is how long packets are held before being written, so those of
+// the other interfaces captured meanwhile are interleaved by timestamp.
+const mergeWindow = 500 * time.Millisecond
+
+type ifPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// captureMerged writes the packets of every handle to a single pcapng file,
+// with one interface per handle, ordered by timestamp. The returned channel
+// is closed once the handles are closed and every packet is written. pcapng
+// timestamps are always in nanoseconds, cut to microseconds as precision
+// says.
+func captureMerged(handles []*pcap.Handle, ifNames []string, out *os.File, precision tsPrecision) <-chan struct{} {
+	var w *pcapgo.NgWriter
+	for i, handle := range handles {
+		intf := pcapgo.DefaultNgInterface
+		intf.Name = ifNames[i]
+		intf.LinkType = handle.LinkType()
+		intf.SnapLength = 1600
+		var err error
+		if w == nil {
+			w, err = pcapgo.NewNgWriterInterface(out, intf, pcapgo.DefaultNgWriterOptions)
+		} else {
+			_, err = w.AddInterface(intf)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		logger.WithError(err).WithField("stages", trace.stages).Error("Error requesting traefik releases")
-		return true
+	packets := make(chan ifPacket, 1024)
+	var wg sync.WaitGroup
+	for i, handle := range handles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+			for packet := range packetSource.Packets() {
+				ci := packet.Metadata().CaptureInfo
+				ci.InterfaceIndex = i
+				ci.Timestamp = precision.round(ci.Timestamp)
+				packets <- ifPacket{ci: ci, data: packet.Data()}
+			}
+		}()
 	}
-	defer resp.Body.Close()
+	go func() {
+		wg.Wait()
+		close(packets)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var pending []ifPacket
+		// flush writes the pending packets captured before t.
+		flush := func(t time.Time) {
+			sort.SliceStable(pending, func(i, j int) bool {
+				return pending[i].ci.Timestamp.Before(pending[j].ci.Timestamp)
+			})
+			n := 0
+			for ; n < len(pending) && pending[n].ci.Timestamp.Before(t); n++ {
+				if err := w.WritePacket(pending[n].ci, pending[n].data); err != nil {
+					log.Println("Error writing packet:", err)
+				}
+			}
+			pending = pending[n:]
+		}
+
+		ticker := time.NewTicker(mergeWindow / 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case packet, ok := <-packets:
+				if !ok {
+					flush(time.Now().Add(time.Hour))
+					if err := w.Flush(); err != nil {
+						log.Println("Error writing packets:", err)
+					}
+					return
+				}
+				pending = append(pending, packet)
+			case now := <-ticker.C:
+				flush(now.Add(-mergeWindow))
+			}
+		}
+	}()
 
-	_, _ = io.Copy(io.Discard, resp.Body)
-	logger.WithField("stages", trace.stages).Info("Requested traefik releases")
+	return done
+}
 
-	return false
+// openCapture opens the capture handle of ifName. For --ts-precision=nano it
+// asks libpcap for nanosecond timestamps, which pcap.OpenLive never does, and
+// falls back to OpenLive with a warning when that fails; the packets are then
+// only as precise as microseconds.
+func openCapture(logger *logrus.Logger, ifName string, precision tsPrecision) (*pcap.Handle, error) {
+	if precision == "nano" {
+		handle, err := openNanoCapture(ifName)
+		if err == nil && handle.Resolution() == gopacket.TimestampResolutionNanosecond {
+			return handle, nil
+		}
+		if handle != nil {
+			handle.Close()
+		}
+		logger.WithField("interface", ifName).WithError(err).Warn("Capture timestamps in microseconds only, despite --ts-precision=nano")
+	}
+	return pcap.OpenLive(ifName, 1600, true, pcap.BlockForever)
+}
+
+// openNanoCapture opens ifName as OpenLive does, through an inactive handle
+// whose Activate asks for nanosecond timestamps (gopacket has no setter of
+// its own for it).
+func openNanoCapture(ifName string) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(ifName)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+	if err := inactive.SetSnapLen(1600); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(true); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return nil, err
+	}
+	return inactive.Activate()
 }
 
-func doRequestAndCapture(ifName string) bool {
+// doRequestAndCaptureMerged captures on several interfaces into one pcapng
+// file while doing a request.
+func doRequestAndCaptureMerged(r *Runner, ifNames []string) *RequestResult {
 	now := time.Now()
 
-	logger := logrus.New()
-	logger.SetLevel(logrus.DebugLevel)
-	logger.SetFormatter(&logrus.JSONFormatter{})
-	logFile, err := os.Create(fmt.Sprintf("out/%d-log.log", now.Unix()))
+	runID := fmt.Sprint(now.Unix())
+	logger, closeLog := r.newLogger(runID)
+	defer closeLog()
+
+	handles := make([]*pcap.Handle, 0, len(ifNames))
+	for _, ifName := range ifNames {
+		handle, err := openCapture(logger, ifName, r.cfg.TSPrecision)
+		if err != nil {
+			logger.WithField("interface", ifName).Fatal(err)
+		}
+		handles = append(handles, handle)
+	}
+
+	pcapPath, err := r.filePath("-output.pcapng")
 	if err != nil {
 		logger.Fatal(err)
 	}
-	logger.SetOutput(logFile)
-	defer logFile.Close()
+	pcapFile, err := os.Create(pcapPath)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer pcapFile.Close()
 
-	handle, err := pcap.OpenLive(ifName, 1600, true, pcap.BlockForever)
+	logger.WithField("interfaces", ifNames).Info("starting capture")
+	done := captureMerged(handles, ifNames, pcapFile, r.cfg.TSPrecision)
+
+	secretPath, err := r.filePath("-secret.txt")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	secretOut, err := os.Create(secretPath)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer secretOut.Close()
+
+	result := r.doRequestCaptured(logger, runID, secretOut, pcapPath, func() {
+		time.Sleep(2 * time.Second) // wait 2 seconds to write pcap
+		for _, handle := range handles {
+			handle.Close()
+		}
+		<-done
+	})
+	if r.cfg.KeyLogPerRun {
+		r.pairKeyLog(logger, runID, "-output.pcapng")
+	}
+	return result
+}
+
+func doRequestAndCapture(r *Runner, ifName string) *RequestResult {
+	now := time.Now()
+
+	runID := fmt.Sprint(now.Unix())
+	logger, closeLog := r.newLogger(runID)
+	defer closeLog()
+
+	handle, err := openCapture(logger, ifName, r.cfg.TSPrecision)
 	if err != nil {
 		logger.Fatal(err)
 	}
 	//defer handle.Close()
 
-	pcapFile, err := os.Create(fmt.Sprintf("out/%d-output.pcap", now.Unix()))
+	pcapPath, err := r.filePath("-output.pcap")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	pcapFile, err := os.Create(pcapPath)
 	if err != nil {
 		logger.Fatal(err)
 	}
 	defer pcapFile.Close()
 
 	logger.Info("starting capture")
-	go capture(handle, pcapFile)
+	done := make(chan struct{})
+	go func() {
+		capture(handle, pcapFile, r.cfg.TSPrecision)
+		close(done)
+	}()
 
-	secretOut, err := os.Create(fmt.Sprintf("out/%d-secret.txt", now.Unix()))
+	secretPath, err := r.filePath("-secret.txt")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	secretOut, err := os.Create(secretPath)
 	if err != nil {
 		logger.Fatal(err)
 	}
 	defer secretOut.Close()
 
-	found := doRequest(logger, secretOut)
-	time.Sleep(2 * time.Second) // wait 2 seconds to write pcap
-	handle.Close()              // close here
+	result := r.doRequestCaptured(logger, runID, secretOut, pcapPath, func() {
+		time.Sleep(2 * time.Second) // wait 2 seconds to write pcap
+		handle.Close()              // close here
+		<-done
+	})
+	if r.cfg.KeyLogPerRun {
+		r.pairKeyLog(logger, runID, "-output.pcap")
+	}
+	return result
+}
+
+// doRequestCaptured does the request of a capture, stopped by stop, and adds
+// the stages of the capture to the result before it's exported.
+func (r *Runner) doRequestCaptured(logger *logrus.Logger, runID string, secretOut *os.File, pcapPath string, stop func()) *RequestResult {
+	// The loop stops the capture too when it abandons a stuck request.
+	var stopOnce sync.Once
+	finalize := func() {
+		stopOnce.Do(func() {
+			// The keys have to be on disk by the time the capture is, or
+			// the last handshakes can't be decrypted.
+			if err := secretOut.Sync(); err != nil {
+				logger.WithError(err).Warn("Error flushing the TLS key log")
+			}
+			stop()
+		})
+	}
+	r.stopCapture.Store(&finalize)
+	r.afterRequest = func(result *RequestResult) {
+		// Called for every step of a sequence, once all are done.
+		finalize()
+		if err := addCaptureStages(result, pcapPath, r.cfg); err != nil {
+			logger.WithError(err).Warn("Error reading the capture")
+		}
+	}
+	defer func() {
+		r.afterRequest = nil
+		r.stopCapture.Store(nil)
+	}()
 
-	return found
+	result := r.doRequest(logger, runID, secretOut)
+	finalize()
+	return result
+}
+
+// pairKeyLog writes the -pairing.json sidecar of --tls-keylog-per-run, which
+// names the capture and the TLS key log of the run and how to open them
+// together. It's written once the outcome of the run is known, so the paths
+// are final.
+func (r *Runner) pairKeyLog(logger *logrus.Logger, runID, pcapSuffix string) {
+	pcapPath, err := r.filePath(pcapSuffix)
+	if err != nil {
+		logger.WithError(err).Warn("Error writing the key log pairing")
+		return
+	}
+	keyLogPath, _ := r.filePath("-secret.txt")
+	pairingPath, _ := r.filePath("-pairing.json")
+	data, err := json.MarshalIndent(map[string]string{
+		"runID":     runID,
+		"pcap":      pcapPath,
+		"keylog":    keyLogPath,
+		"wireshark": "wireshark -o " + shellQuote("tls.keylog_file:"+keyLogPath) + " -r " + shellQuote(pcapPath),
+		"editcap":   "editcap --inject-secrets " + shellQuote("tls,"+keyLogPath) + " " + shellQuote(pcapPath) + " " + shellQuote(strings.TrimSuffix(pcapPath, filepath.Ext(pcapPath))+"-decrypted.pcapng"),
+	}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(pairingPath, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Error writing the key log pairing")
+	}
 }
 
 func main() {
-	args := os.Args[1:]
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(compareMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(reportMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateMain(os.Args[2:]))
+	}
+
+	cfg := parseFlags()
+	args := flag.Args()
 	if len(args) == 0 {
-		fmt.Println("Usage: go run main.go <if>\n\tFor example: go run main.go eth0")
-		os.Exit(1)
+		fmt.Println("Usage: go run . [flags] <if>[,<if>...]\n\tFor example: go run . eth0")
+		os.Exit(exitUsage)
 	}
 
 	ifName := args[0]
+	ifNames := strings.Split(ifName, ",")
 	_ = os.MkdirAll("out", 0755)
 
-	fmt.Println("Capturing", ifName)
-	for {
-		fmt.Println("Trying HTTP request...")
-		if doRequestAndCapture(ifName) {
-			fmt.Println("connection error found!!!")
-			break
-		}
+	r, err := NewRunner(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitUsage)
 	}
+
+	r.progress("Capturing", ifName)
+	os.Exit(r.loop(func() *RequestResult {
+		if len(ifNames) > 1 {
+			return doRequestAndCaptureMerged(r, ifNames)
+		}
+		return doRequestAndCapture(r, ifName)
+	}))
 }
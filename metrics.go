@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// driftWarmup is the number of samples a phase needs before drift is reported.
+const driftWarmup = 5
+
+type ewma struct {
+	mean     float64
+	variance float64
+	count    int
+}
+
+func (e *ewma) update(x, alpha float64) {
+	if e.count == 0 {
+		e.mean = x
+		e.count++
+		return
+	}
+	diff := x - e.mean
+	incr := alpha * diff
+	e.mean += incr
+	e.variance = (1 - alpha) * (e.variance + diff*incr)
+	e.count++
+}
+
+func (e *ewma) stddev() float64 {
+	return math.Sqrt(e.variance)
+}
+
+type Metrics struct {
+	mu    sync.Mutex
+	alpha float64
+	drift float64
+	ewma  map[string]*ewma
+
+	buckets    histogramBuckets
+	histograms map[string]*histogram
+
+	conns       int
+	reusedConns int
+
+	// samples are the durations of every phase so far, kept for --slo and
+	// --report-interval only.
+	samples map[string][]time.Duration
+
+	// requests, failures and categories count the requests so far for
+	// --report-interval, and recentFailures lists the failures since the
+	// last report.
+	requests        int
+	failures        int
+	categories      map[string]int
+	recentFailures  []recentFailure
+	droppedFailures int
+
+	// outcomes are those of the requests of the last readyWindow.
+	readyWindow time.Duration
+	outcomes    []outcome
+}
+
+// outcome is whether a request done at t succeeded.
+type outcome struct {
+	t  time.Time
+	ok bool
+}
+
+func NewMetrics(cfg *Config) *Metrics {
+	m := &Metrics{
+		alpha: cfg.DriftAlpha,
+		drift: cfg.DriftThreshold,
+		ewma:  make(map[string]*ewma),
+
+		buckets:    cfg.HistBuckets,
+		histograms: make(map[string]*histogram),
+
+		readyWindow: cfg.ReadyWindow,
+		categories:  make(map[string]int),
+	}
+	if len(cfg.SLOs) > 0 || cfg.ReportInterval > 0 {
+		m.samples = make(map[string][]time.Duration)
+	}
+	return m
+}
+
+// observe feeds the phase durations of one request into the moving averages
+// and warns about phases that deviate from them.
+func (m *Metrics) observe(logger *logrus.Logger, durations map[string]time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, d := range durations {
+		x := d.Seconds()
+		e, ok := m.ewma[name]
+		if !ok {
+			e = &ewma{}
+			m.ewma[name] = e
+		}
+
+		if m.drift > 0 && e.count >= driftWarmup {
+			stddev := e.stddev()
+			if stddev > 0 && math.Abs(x-e.mean) > m.drift*stddev {
+				logger.WithFields(logrus.Fields{
+					"phase":    name,
+					"duration": d.String(),
+					"ewma":     time.Duration(e.mean * float64(time.Second)).String(),
+					"stddev":   time.Duration(stddev * float64(time.Second)).String(),
+				}).Warn("Phase duration drifted from moving average")
+			}
+		}
+		e.update(x, m.alpha)
+		h, ok := m.histograms[name]
+		if !ok {
+			h = &histogram{}
+			m.histograms[name] = h
+		}
+		h.observe(m.buckets, d)
+		if m.samples != nil {
+			m.samples[name] = append(m.samples[name], d)
+		}
+	}
+}
+
+// phaseSamples returns the durations of phase so far, sorted.
+func (m *Metrics) phaseSamples(phase string) []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	samples := slices.Clone(m.samples[phase])
+	slices.Sort(samples)
+	return samples
+}
+
+// observeConn tallies whether a request got a pooled connection, from its
+// GotConn stage.
+func (m *Metrics) observeConn(stages []Stage) {
+	stage, ok := findStage(stages, "GotConn")
+	if !ok {
+		return
+	}
+	reused, _ := stage.Values["reused"].(bool)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns++
+	if reused {
+		m.reusedConns++
+	}
+}
+
+// observeOutcome records whether a request succeeded, for /readyz.
+func (m *Metrics) observeOutcome(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.outcomes = append(m.outcomes, outcome{t: now, ok: ok})
+	m.pruneOutcomes(now)
+}
+
+func (m *Metrics) pruneOutcomes(now time.Time) {
+	n := 0
+	for n < len(m.outcomes) && now.Sub(m.outcomes[n].t) > m.readyWindow {
+		n++
+	}
+	m.outcomes = m.outcomes[n:]
+}
+
+// readiness returns how many of the requests of the last ready window
+// succeeded.
+func (m *Metrics) readiness() (succeeded, total int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneOutcomes(time.Now())
+	for _, o := range m.outcomes {
+		if o.ok {
+			succeeded++
+		}
+	}
+	return succeeded, len(m.outcomes)
+}
+
+// connReuse returns how many of the connections so far were reused.
+func (m *Metrics) connReuse() (reused, total int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reusedConns, m.conns
+}
+
+func (m *Metrics) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.ewma))
+	for name := range m.ewma {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# TYPE dump_pcap_phase_duration_ewma_seconds gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "dump_pcap_phase_duration_ewma_seconds{phase=%q} %g\n", name, m.ewma[name].mean)
+	}
+	fmt.Fprintln(w, "# TYPE dump_pcap_phase_duration_ewma_stddev_seconds gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "dump_pcap_phase_duration_ewma_stddev_seconds{phase=%q} %g\n", name, m.ewma[name].stddev())
+	}
+	fmt.Fprintln(w, "# TYPE dump_pcap_phase_duration_seconds histogram")
+	for _, name := range names {
+		m.histograms[name].write(w, "dump_pcap_phase_duration_seconds", name, m.buckets)
+	}
+	fmt.Fprintln(w, "# TYPE dump_pcap_connections_total counter")
+	fmt.Fprintf(w, "dump_pcap_connections_total %d\n", m.conns)
+	fmt.Fprintln(w, "# TYPE dump_pcap_connections_reused_total counter")
+	fmt.Fprintf(w, "dump_pcap_connections_reused_total %d\n", m.reusedConns)
+	if m.conns > 0 {
+		fmt.Fprintln(w, "# TYPE dump_pcap_connection_reuse_ratio gauge")
+		fmt.Fprintf(w, "dump_pcap_connection_reuse_ratio %g\n", float64(m.reusedConns)/float64(m.conns))
+	}
+}
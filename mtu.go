@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// mtuSafeSize is the largest packet sure to make it through any path,
+	// the minimum MTU of IPv6.
+	mtuSafeSize = 1280
+	// mtuRetransmits is how many times a large segment is sent again before
+	// it's suspected of being dropped for its size.
+	mtuRetransmits = 2
+)
+
+// segment is a TCP segment with a payload not acked yet, size being the
+// size of its IP packet.
+type segment struct {
+	end  uint32
+	size int
+	sent int
+}
+
+// onSegment follows a segment of the side side for MTU black holes: a packet
+// larger than mtuSafeSize and than any of the side acked so far, sent again
+// and again, is likely dropped on the path without the "fragmentation needed"
+// that would have told the sender.
+func (c *pcapConn) onSegment(t time.Time, side string, seq uint32, payload, size int) {
+	if c.inflight[side] == nil {
+		c.inflight[side] = map[uint32]*segment{}
+	}
+	seg, ok := c.inflight[side][seq]
+	if !ok || seg.end != seq+uint32(payload) {
+		c.inflight[side][seq] = &segment{end: seq + uint32(payload), size: size, sent: 1}
+		return
+	}
+	seg.sent++
+	delivered := c.delivered[side]
+	if seg.sent-1 < mtuRetransmits || seg.size <= mtuSafeSize || seg.size <= delivered {
+		return
+	}
+	c.add("PossibleMTUIssue", t, map[string]interface{}{
+		"reason":           "retransmitted",
+		"from":             side,
+		"size":             seg.size,
+		"retransmits":      seg.sent - 1,
+		"largestDelivered": delivered,
+		"detail":           fmt.Sprintf("%d-byte packet sent %d times, largest delivered %d bytes", seg.size, seg.sent, delivered),
+	})
+}
+
+// onAck drops the segments of the side side acked by ack, remembering the
+// largest packet that made it.
+func (c *pcapConn) onAck(side string, ack uint32) {
+	for seq, seg := range c.inflight[side] {
+		if int32(seg.end-ack) > 0 {
+			continue
+		}
+		c.delivered[side] = max(c.delivered[side], seg.size)
+		delete(c.inflight[side], seq)
+	}
+}
+
+// onICMP records an ICMP "fragmentation needed" or ICMPv6 "packet too big"
+// about a packet of a captured connection, with the MTU of the hop that
+// dropped it and the size of the packet. It returns false when packet isn't
+// ICMP.
+func (r *pcapReport) onICMP(t time.Time, packet gopacket.Packet) bool {
+	var reason string
+	var mtu int
+	var original gopacket.Packet
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		if icmp.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded) {
+			return true
+		}
+		// The next-hop MTU is where the sequence number of an echo is.
+		reason, mtu = "icmp fragmentation needed", int(icmp.Seq)
+		original = gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+	} else if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		if icmp.TypeCode.Type() != layers.ICMPv6TypePacketTooBig || len(icmp.Payload) < 4 {
+			return true
+		}
+		reason, mtu = "icmpv6 packet too big", int(binary.BigEndian.Uint32(icmp.Payload))
+		original = gopacket.NewPacket(icmp.Payload[4:], layers.LayerTypeIPv6, gopacket.Default)
+	} else {
+		return false
+	}
+
+	// The original packet is cut after the first bytes of its TCP header,
+	// too few for gopacket to decode but enough for the ports.
+	var src, dst net.IP
+	var size int
+	var transport []byte
+	switch network := original.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst, size = network.SrcIP, network.DstIP, int(network.Length)
+		transport = network.Payload
+		if network.Protocol != layers.IPProtocolTCP {
+			return true
+		}
+	case *layers.IPv6:
+		src, dst, size = network.SrcIP, network.DstIP, int(network.Length)+40
+		transport = network.Payload
+		if network.NextHeader != layers.IPProtocolTCP {
+			return true
+		}
+	default:
+		return true
+	}
+	if len(transport) < 4 {
+		return true
+	}
+	from := net.JoinHostPort(src.String(), fmt.Sprint(binary.BigEndian.Uint16(transport[0:2])))
+	to := net.JoinHostPort(dst.String(), fmt.Sprint(binary.BigEndian.Uint16(transport[2:4])))
+	conn := r.conns[connKey(from, to)]
+	if conn == nil {
+		return true
+	}
+	side := "server"
+	if from == conn.client {
+		side = "client"
+	}
+	conn.add("PossibleMTUIssue", t, map[string]interface{}{
+		"reason": reason,
+		"from":   side,
+		"size":   size,
+		"mtu":    mtu,
+		"detail": fmt.Sprintf("%d-byte packet over the MTU %d of a hop", size, mtu),
+	})
+	return true
+}
+
+// addMTUIssue adds the PossibleMTUIssue stage of the captured connection of
+// the request to result, with the client and server addresses and the last
+// stage of the trace before it. A connection hanging after its handshake
+// looks like any timeout to httptrace.
+func addMTUIssue(result *RequestResult, report *pcapReport) bool {
+	conn := requestConn(result.Stages, report)
+	if conn == nil {
+		return false
+	}
+	issue, ok := findStage(conn.stages, "PossibleMTUIssue")
+	if !ok {
+		return false
+	}
+
+	values := map[string]interface{}{
+		"client": conn.client,
+		"server": conn.server,
+	}
+	for key, value := range issue.Values {
+		if key != "detail" && key != "interface" {
+			values[key] = value
+		}
+	}
+	afterStage := ""
+	for _, stage := range result.Stages {
+		if !stage.Time.After(issue.Time) {
+			afterStage = stage.Name
+		}
+	}
+	values["afterStage"] = afterStage
+	result.Stages = append(result.Stages, Stage{Name: "PossibleMTUIssue", Time: issue.Time, Values: values})
+	return true
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// Flags of the NTLM messages: Unicode strings, NTLM with extended session
+// security, the target info of the server for NTLMv2, and 128-bit keys.
+const (
+	ntlmUnicode         = 0x00000001
+	ntlmOEM             = 0x00000002
+	ntlmRequestTarget   = 0x00000004
+	ntlmNTLM            = 0x00000200
+	ntlmAlwaysSign      = 0x00008000
+	ntlmExtendedSession = 0x00080000
+	ntlmTargetInfo      = 0x00800000
+	ntlm128             = 0x20000000
+	ntlm56              = 0x80000000
+
+	ntlmNegotiateFlags = ntlmUnicode | ntlmOEM | ntlmRequestTarget | ntlmNTLM | ntlmAlwaysSign | ntlmExtendedSession | ntlmTargetInfo | ntlm128 | ntlm56
+
+	// The AV pairs of the target info: the end of the list, the flags of the
+	// client, the MIC one telling the AUTHENTICATE_MESSAGE has a MIC, and the
+	// time of the server.
+	ntlmAvEOL       = 0
+	ntlmAvFlags     = 6
+	ntlmAvFlagMIC   = 0x00000002
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiate returns the NEGOTIATE_MESSAGE starting the handshake,
+// without domain nor workstation.
+func ntlmNegotiate() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmNegotiateFlags)
+	return b
+}
+
+// ntlmChallenge is what the client needs of the CHALLENGE_MESSAGE of the
+// server.
+type ntlmChallenge struct {
+	// message is the whole CHALLENGE_MESSAGE, part of the MIC.
+	message    []byte
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+// ntlmField returns the payload of the security buffer of b at offset.
+func ntlmField(b []byte, offset int) ([]byte, error) {
+	if len(b) < offset+8 {
+		return nil, errors.New("ntlm: message too short")
+	}
+	n := int(binary.LittleEndian.Uint16(b[offset:]))
+	start := int(binary.LittleEndian.Uint32(b[offset+4:]))
+	if start+n > len(b) {
+		return nil, errors.New("ntlm: field out of the message")
+	}
+	return b[start : start+n], nil
+}
+
+func parseNTLMChallenge(b []byte) (*ntlmChallenge, error) {
+	if len(b) < 32 || !bytes.Equal(b[:8], ntlmSignature) || binary.LittleEndian.Uint32(b[8:]) != 2 {
+		return nil, errors.New("ntlm: not a challenge message")
+	}
+	c := &ntlmChallenge{
+		message:   b,
+		flags:     binary.LittleEndian.Uint32(b[20:]),
+		challenge: b[24:32],
+	}
+	if c.flags&ntlmTargetInfo != 0 && len(b) >= 48 {
+		info, err := ntlmField(b, 40)
+		if err != nil {
+			return nil, err
+		}
+		c.targetInfo = info
+	}
+	return c, nil
+}
+
+// ntlmAVPairs calls f with the id and value of every AV pair of info up to
+// the MsvAvEOL.
+func ntlmAVPairs(info []byte, f func(id uint16, value []byte)) {
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		n := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvEOL || len(info) < 4+n {
+			return
+		}
+		f(id, info[4:4+n])
+		info = info[4+n:]
+	}
+}
+
+// timestamp returns the time of the server in its target info, as a
+// FILETIME, and true, else the time of the client and false.
+func (c *ntlmChallenge) timestamp() ([]byte, bool) {
+	var timestamp []byte
+	ntlmAVPairs(c.targetInfo, func(id uint16, value []byte) {
+		if id == ntlmAvTimestamp && len(value) == 8 {
+			timestamp = value
+		}
+	})
+	if timestamp != nil {
+		return timestamp, true
+	}
+	// 100-nanosecond intervals since 1601.
+	t := uint64(time.Now().UnixNano()/100) + 116444736000000000
+	return binary.LittleEndian.AppendUint64(nil, t), false
+}
+
+// targetInfoWithMIC returns the target info of the server with the MIC flag
+// set in its MsvAvFlags, added if need be.
+func (c *ntlmChallenge) targetInfoWithMIC() []byte {
+	var info []byte
+	var flags uint32
+	ntlmAVPairs(c.targetInfo, func(id uint16, value []byte) {
+		if id == ntlmAvFlags && len(value) == 4 {
+			flags = binary.LittleEndian.Uint32(value)
+			return
+		}
+		info = binary.LittleEndian.AppendUint16(info, id)
+		info = binary.LittleEndian.AppendUint16(info, uint16(len(value)))
+		info = append(info, value...)
+	})
+	info = binary.LittleEndian.AppendUint16(info, ntlmAvFlags)
+	info = binary.LittleEndian.AppendUint16(info, 4)
+	info = binary.LittleEndian.AppendUint32(info, flags|ntlmAvFlagMIC)
+	return append(info, 0, 0, 0, 0)
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, r)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// ntowfv2 is the NTLMv2 response key of the credentials, the HMAC-MD5 of
+// the upper case user and the domain keyed with the MD4 of the password.
+func ntowfv2(user, password, domain string) []byte {
+	hash := md4.New()
+	hash.Write(utf16le(password))
+	return hmacMD5(hash.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+}
+
+// ntlmv2Responses returns the NTLMv2 and LMv2 responses to serverChallenge
+// and the session base key, the key of the MIC.
+func ntlmv2Responses(ntowf, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (ntResponse, lmResponse, sessionKey []byte) {
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+	proof := hmacMD5(ntowf, serverChallenge, blob)
+	ntResponse = append(proof, blob...)
+	lmResponse = append(hmacMD5(ntowf, serverChallenge, clientChallenge), clientChallenge...)
+	return ntResponse, lmResponse, hmacMD5(ntowf, proof)
+}
+
+// ntlmAuthenticate returns the AUTHENTICATE_MESSAGE answering challenge
+// with the NTLMv2 responses of the credentials, user being DOMAIN\user or
+// user alone.
+func ntlmAuthenticate(challenge *ntlmChallenge, user, password string) ([]byte, error) {
+	// The client challenge is a nonce of the handshake, random whatever
+	// --seed.
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	return challenge.authenticate(user, password, clientChallenge), nil
+}
+
+func (c *ntlmChallenge) authenticate(user, password string, clientChallenge []byte) []byte {
+	domain := ""
+	if d, u, ok := strings.Cut(user, `\`); ok {
+		domain, user = d, u
+	}
+
+	// A server sending its time expects a MIC over the three messages,
+	// flagged in the target info of the response, and no LMv2 response
+	// (MS-NLMP 3.1.5.1.2).
+	timestamp, mic := c.timestamp()
+	targetInfo := c.targetInfo
+	if mic {
+		targetInfo = c.targetInfoWithMIC()
+	}
+	ntResponse, lmResponse, sessionKey := ntlmv2Responses(ntowfv2(user, password, domain), c.challenge, clientChallenge, timestamp, targetInfo)
+	if mic {
+		lmResponse = make([]byte, 24)
+	}
+
+	encode := func(s string) []byte {
+		if c.flags&ntlmUnicode != 0 {
+			return utf16le(s)
+		}
+		return []byte(s)
+	}
+	// The security buffers of the LM and NT responses, the domain, the user,
+	// the workstation and the session key, the flags, the version (zero, it
+	// isn't negotiated) and the MIC, then the payloads.
+	fields := [][]byte{lmResponse, ntResponse, encode(domain), encode(user), nil, nil}
+	const header = 88
+	b := make([]byte, header)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	for i, field := range fields {
+		offset := 12 + 8*i
+		binary.LittleEndian.PutUint16(b[offset:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(b[offset+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(b[offset+4:], uint32(len(b)))
+		b = append(b, field...)
+	}
+	binary.LittleEndian.PutUint32(b[60:], c.flags&ntlmNegotiateFlags)
+	if mic {
+		// Without key exchange, the exported session key is the session
+		// base key.
+		copy(b[72:], hmacMD5(sessionKey, ntlmNegotiate(), c.message, b))
+	}
+	return b
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/md4"
+)
+
+// The known answers of MS-NLMP 4.2.4, NTLMv2 authentication of Domain\User
+// with the password Password.
+var (
+	ntlmTestServerChallenge = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	ntlmTestClientChallenge = bytes.Repeat([]byte{0xaa}, 8)
+	// ntlmTestTargetInfo is MsvAvNbDomainName Domain, MsvAvNbComputerName
+	// Server and MsvAvEOL.
+	ntlmTestTargetInfo = mustHex("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestNTLMv2KnownAnswers(t *testing.T) {
+	hash := md4.New()
+	hash.Write(utf16le("Password"))
+	if got, want := hash.Sum(nil), mustHex("a4f49c406510bdcab6824ee7c30fd852"); !bytes.Equal(got, want) {
+		t.Errorf("NTOWFv1 = %x, want %x", got, want)
+	}
+
+	ntowf := ntowfv2("User", "Password", "Domain")
+	if want := mustHex("0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(ntowf, want) {
+		t.Errorf("NTOWFv2 = %x, want %x", ntowf, want)
+	}
+
+	ntResponse, lmResponse, sessionKey := ntlmv2Responses(ntowf, ntlmTestServerChallenge, ntlmTestClientChallenge, make([]byte, 8), ntlmTestTargetInfo)
+	tests := []struct {
+		name      string
+		got, want []byte
+	}{
+		{"NTProofStr", ntResponse[:16], mustHex("68cd0ab851e51c96aabc927bebef6a1c")},
+		{"blob", ntResponse[16:], append(append(mustHex("0101000000000000"+"0000000000000000"+"aaaaaaaaaaaaaaaa"+"00000000"), ntlmTestTargetInfo...), 0, 0, 0, 0)},
+		{"LMv2", lmResponse, mustHex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa")},
+		{"SessionBaseKey", sessionKey, mustHex("8de40ccadbc14a82f15cb0ad0de95ca3")},
+	}
+	for _, test := range tests {
+		if !bytes.Equal(test.got, test.want) {
+			t.Errorf("%s = %x, want %x", test.name, test.got, test.want)
+		}
+	}
+}
+
+// ntlmTestChallenge returns a CHALLENGE_MESSAGE with the target info of
+// MS-NLMP 4.2.4, and the time of the server when timestamp.
+func ntlmTestChallenge(timestamp bool) []byte {
+	info := append([]byte(nil), ntlmTestTargetInfo[:len(ntlmTestTargetInfo)-4]...)
+	if timestamp {
+		info = binary.LittleEndian.AppendUint16(info, ntlmAvTimestamp)
+		info = binary.LittleEndian.AppendUint16(info, 8)
+		info = binary.LittleEndian.AppendUint64(info, 133000000000000000)
+	}
+	info = append(info, 0, 0, 0, 0)
+
+	b := make([]byte, 48)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 2)
+	binary.LittleEndian.PutUint32(b[16:], 48)
+	binary.LittleEndian.PutUint32(b[20:], ntlmNegotiateFlags)
+	copy(b[24:], ntlmTestServerChallenge)
+	binary.LittleEndian.PutUint16(b[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(b[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(b[44:], 48)
+	return append(b, info...)
+}
+
+// verifyNTLMAuthenticate checks an AUTHENTICATE_MESSAGE answering challenge
+// as a server knowing the credentials would: the user and domain, the
+// NTProofStr, and the MIC when the target info of the response flags one.
+func verifyNTLMAuthenticate(challenge, msg []byte, domain, user, password string) error {
+	if len(msg) < 88 || !bytes.HasPrefix(msg, ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		return errors.New("not an authenticate message")
+	}
+	ntResponse, err := ntlmField(msg, 20)
+	if err != nil {
+		return err
+	}
+	if len(ntResponse) < 16+28 {
+		return errors.New("NT response too short")
+	}
+	if got, err := ntlmField(msg, 28); err != nil || !bytes.Equal(got, utf16le(domain)) {
+		return fmt.Errorf("domain %q, want %q", got, domain)
+	}
+	if got, err := ntlmField(msg, 36); err != nil || !bytes.Equal(got, utf16le(user)) {
+		return fmt.Errorf("user %q, want %q", got, user)
+	}
+
+	ntowf := ntowfv2(user, password, domain)
+	proof, blob := ntResponse[:16], ntResponse[16:]
+	if !hmac.Equal(proof, hmacMD5(ntowf, challenge[24:32], blob)) {
+		return errors.New("wrong NTProofStr")
+	}
+
+	mic := false
+	ntlmAVPairs(blob[28:], func(id uint16, value []byte) {
+		if id == ntlmAvFlags && len(value) == 4 {
+			mic = binary.LittleEndian.Uint32(value)&ntlmAvFlagMIC != 0
+		}
+	})
+	if !mic {
+		return nil
+	}
+	zeroed := append([]byte(nil), msg...)
+	copy(zeroed[72:88], make([]byte, 16))
+	if !hmac.Equal(msg[72:88], hmacMD5(hmacMD5(ntowf, proof), ntlmNegotiate(), challenge, zeroed)) {
+		return errors.New("wrong MIC")
+	}
+	return nil
+}
+
+func TestNTLMAuthenticate(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp bool
+		wantMIC   bool
+	}{
+		{"without server time", false, false},
+		{"with server time", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := ntlmTestChallenge(test.timestamp)
+			challenge, err := parseNTLMChallenge(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := challenge.authenticate(`Domain\User`, "Password", ntlmTestClientChallenge)
+			if err := verifyNTLMAuthenticate(message, msg, "Domain", "User", "Password"); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyNTLMAuthenticate(message, msg, "Domain", "User", "wrong"); err == nil {
+				t.Error("verified with the wrong password")
+			}
+
+			hasMIC := !bytes.Equal(msg[72:88], make([]byte, 16))
+			if hasMIC != test.wantMIC {
+				t.Errorf("MIC %x, want one: %v", msg[72:88], test.wantMIC)
+			}
+			lmResponse, _ := ntlmField(msg, 12)
+			if zero := bytes.Equal(lmResponse, make([]byte, 24)); zero != test.wantMIC {
+				t.Errorf("LM response %x, want zeros: %v", lmResponse, test.wantMIC)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Span is one phase of a request, or the request itself for the root span.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	random.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// buildSpans turns a result into a root span covering the whole request and
+// a child span per phase.
+func buildSpans(runID string, result *RequestResult) []Span {
+	// Join the trace of the traceparent header the server got, if any.
+	traceID, spanID := result.TraceID, result.SpanID
+	if traceID == "" {
+		traceID, spanID = randomHex(16), randomHex(8)
+	}
+	root := Span{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Name:    result.Method + " " + result.URL,
+		Start:   result.Start,
+		End:     result.Start,
+		Attributes: map[string]interface{}{
+			"run.id":                    runID,
+			"http.request.method":       result.Method,
+			"url.full":                  result.URL,
+			"http.response.status_code": result.Status,
+			"network.protocol.name":     result.Proto,
+		},
+		Error: result.Error,
+	}
+
+	spans := []Span{root}
+	for _, span := range phaseSpans(result.Stages) {
+		if span.Name == "total" {
+			spans[0].Start, spans[0].End = span.Start, span.End
+			continue
+		}
+		spans = append(spans, Span{
+			TraceID:  traceID,
+			SpanID:   randomHex(8),
+			ParentID: root.SpanID,
+			Name:     span.Name,
+			Start:    span.Start,
+			End:      span.End,
+		})
+	}
+
+	return spans
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		var v otlpValue
+		switch value := value.(type) {
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: key, Value: v})
+	}
+	return out
+}
+
+// otlpRequest builds an OTLP/HTTP JSON ExportTraceServiceRequest.
+func otlpRequest(spans []Span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		s := map[string]interface{}{
+			"traceId":           span.TraceID,
+			"spanId":            span.SpanID,
+			"name":              span.Name,
+			"kind":              3, // SPAN_KIND_CLIENT
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+		}
+		if span.ParentID != "" {
+			s["parentSpanId"] = span.ParentID
+		}
+		if span.Error != "" {
+			s["status"] = map[string]interface{}{"code": 2, "message": span.Error}
+		}
+		otlpSpans = append(otlpSpans, s)
+	}
+
+	serviceName := "dump-pcap"
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: &serviceName}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "dump-pcap"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// OTLPExporter sends every request as spans to an OTLP/HTTP collector.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Export(runID string, result *RequestResult) error {
+	body, err := json.Marshal(otlpRequest(buildSpans(runID, result)))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (e *OTLPExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"time"
+)
+
+type Phase struct {
+	Name  string
+	Start string
+	End   string
+}
+
+// phases are the spans derived from pairs of trace stages, in timeline order.
+var phases = []Phase{
+	{Name: "dns", Start: "DNSStart", End: "DNSDone"},
+	{Name: "connect", Start: "ConnectStart", End: "ConnectDone"},
+	{Name: "tls", Start: "TLSHandshakeStart", End: "TLSHandshakeDone"},
+	{Name: "ttfb", Start: "WroteRequest", End: "GotFirstResponseByte"},
+}
+
+// findStage returns the first stage named name, renamed by --stage-names or
+// not.
+func findStage(stages []Stage, name string) (Stage, bool) {
+	for _, stage := range stages {
+		if (stage.Original == "" && stage.Name == name) || stage.Original == name {
+			return stage, true
+		}
+	}
+	return Stage{}, false
+}
+
+type PhaseSpan struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+func (s PhaseSpan) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// phaseSpans returns every phase whose start and end stages were both
+// recorded, plus "total" from the first to the last stage.
+func phaseSpans(stages []Stage) []PhaseSpan {
+	spans := make([]PhaseSpan, 0, len(phases)+1)
+	for _, phase := range phases {
+		start, ok := findStage(stages, phase.Start)
+		if !ok {
+			continue
+		}
+		end, ok := findStage(stages, phase.End)
+		if !ok {
+			continue
+		}
+		spans = append(spans, PhaseSpan{Name: phase.Name, Start: start.Time, End: end.Time})
+	}
+	if len(stages) > 0 {
+		spans = append(spans, PhaseSpan{Name: "total", Start: stages[0].Time, End: stages[len(stages)-1].Time})
+	}
+
+	return spans
+}
+
+// poolWait returns how long a request waited for a connection of the pool:
+// from GetConn to GotConn of a reused connection, or to the start of the dial
+// of a new one, which under --max-conns-per-host waits for the limit to let
+// it. A dial that lost the race to an idle connection isn't counted.
+func poolWait(stages []Stage) (time.Duration, bool) {
+	getConn, ok := findStage(stages, "GetConn")
+	if !ok {
+		return 0, false
+	}
+	gotConn, ok := findStage(stages, "GotConn")
+	if !ok {
+		return 0, false
+	}
+	end := gotConn.Time
+	if gotConn.Values["reused"] != true {
+		for _, name := range []string{"DNSStart", "ConnectStart"} {
+			if dial, ok := findStage(stages, name); ok && dial.Time.After(getConn.Time) && dial.Time.Before(end) {
+				end = dial.Time
+			}
+		}
+	}
+	return end.Sub(getConn.Time), true
+}
+
+func phaseDurations(stages []Stage) map[string]time.Duration {
+	durations := make(map[string]time.Duration, len(phases)+1)
+	for _, span := range phaseSpans(stages) {
+		durations[span.Name] = span.Duration()
+	}
+	return durations
+}
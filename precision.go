@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// tsPrecision is the precision of the timestamps of the packets captured and
+// of the stages, the same for both so that they can be correlated. Unset,
+// the packets are in microseconds and the stages are left as recorded.
+type tsPrecision string
+
+func (p *tsPrecision) String() string {
+	return string(*p)
+}
+
+func (p *tsPrecision) Set(value string) error {
+	if value != "micro" && value != "nano" {
+		return fmt.Errorf("invalid timestamp precision %q, must be micro or nano", value)
+	}
+	*p = tsPrecision(value)
+	return nil
+}
+
+// round returns t cut to microseconds for micro, as is otherwise. Unlike
+// time.Truncate, it keeps the monotonic clock reading the durations are
+// computed with.
+func (p tsPrecision) round(t time.Time) time.Time {
+	if p != "micro" || t.IsZero() {
+		return t
+	}
+	return t.Add(-time.Duration(t.Nanosecond() % int(time.Microsecond)))
+}
+
+// roundStages cuts the times of result and its stages to the precision.
+func (p tsPrecision) roundStages(result *RequestResult) {
+	result.Start = p.round(result.Start)
+	for i := range result.Stages {
+		result.Stages[i].Time = p.round(result.Stages[i].Time)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// probe dials the host of step with the dial and TLS configuration of
+// client, without a request, for --tcp-only: the DNS, connect and TLS stages
+// are the same as those of a request, so are the phases.
+func (r *Runner) probe(logger *logrus.Logger, client *http.Client, step requestStep) *RequestResult {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		logger.Error("--tcp-only needs the HTTP/1.1 and HTTP/2 transport")
+		return nil
+	}
+	u, err := url.Parse(step.url())
+	if err != nil {
+		logger.WithError(err).Error("Error creating request")
+		return nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	trace := r.newTrace()
+	ctx, stop := r.traceContext(logger, trace)
+	defer stop()
+	// The timeout of the client, as there's no request to bound the dial.
+	ctx, cancel := context.WithTimeout(withBufferedClientTrace(ctx, trace), client.Timeout)
+	defer cancel()
+	result := &RequestResult{
+		URL:   u.String(),
+		Start: time.Now(),
+	}
+	trace.add("Request", map[string]interface{}{
+		"url":         u.String(),
+		"connectHost": addr,
+		"tcpOnly":     true,
+		"slept":       r.slept.String(),
+		"seed":        r.cfg.Seed,
+		"tsPrecision": string(r.cfg.TSPrecision),
+	})
+
+	conn, err := transport.DialContext(ctx, "tcp", addr)
+	if err == nil && u.Scheme == "https" {
+		conn, err = probeTLS(ctx, conn, transport.TLSClientConfig, u.Hostname(), &trace.ClientTrace)
+	}
+	if err != nil {
+		setError(ctx, result, err)
+		r.finish(logger, result, trace)
+		return result
+	}
+	r.connected = true
+	values := map[string]interface{}{
+		"localAddr":  conn.LocalAddr().String(),
+		"remoteAddr": conn.RemoteAddr().String(),
+	}
+	if err := conn.Close(); err != nil {
+		values["closeError"] = err.Error()
+	}
+	trace.add("ConnClosed", values)
+	r.finish(logger, result, trace)
+
+	return result
+}
+
+// probeTLS does the TLS handshake of --tcp-only on conn, calling the TLS
+// callbacks of trace as the transport does.
+func probeTLS(ctx context.Context, conn net.Conn, config *tls.Config, host string, trace *httptrace.ClientTrace) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err := tlsConn.HandshakeContext(ctx)
+	if trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
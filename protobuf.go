@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+
+	"pcap/tracepb"
+)
+
+//go:generate protoc --proto_path=tracepb --go_out=tracepb --go_opt=paths=source_relative trace.proto
+
+// protoValues returns values with the TLS connection states summed up, the
+// certificates by their SHA-256: in DER they're most of an encoded result.
+func protoValues(values map[string]interface{}) map[string]interface{} {
+	compact := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if state, ok := value.(tls.ConnectionState); ok {
+			fingerprints := make([]string, 0, len(state.PeerCertificates))
+			for _, cert := range state.PeerCertificates {
+				sum := sha256.Sum256(cert.Raw)
+				fingerprints = append(fingerprints, hex.EncodeToString(sum[:]))
+			}
+			value = map[string]interface{}{
+				"version":            tls.VersionName(state.Version),
+				"cipherSuite":        tls.CipherSuiteName(state.CipherSuite),
+				"negotiatedProtocol": state.NegotiatedProtocol,
+				"serverName":         state.ServerName,
+				"peerCertificates":   fingerprints,
+			}
+		}
+		compact[key] = value
+	}
+	return compact
+}
+
+// protoValue converts a value decoded from JSON with json.Decoder.UseNumber
+// to a Value of trace.proto.
+func protoValue(v interface{}) (*tracepb.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return &tracepb.Value{}, nil
+	case string:
+		return &tracepb.Value{Kind: &tracepb.Value_StringValue{StringValue: v}}, nil
+	case bool:
+		return &tracepb.Value{Kind: &tracepb.Value_BoolValue{BoolValue: v}}, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return &tracepb.Value{Kind: &tracepb.Value_IntValue{IntValue: i}}, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return &tracepb.Value{Kind: &tracepb.Value_DoubleValue{DoubleValue: f}}, nil
+	case []interface{}:
+		list := &tracepb.ValueList{Values: make([]*tracepb.Value, 0, len(v))}
+		for _, elem := range v {
+			value, err := protoValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			list.Values = append(list.Values, value)
+		}
+		return &tracepb.Value{Kind: &tracepb.Value_ListValue{ListValue: list}}, nil
+	case map[string]interface{}:
+		fields, err := protoFields(v)
+		if err != nil {
+			return nil, err
+		}
+		return &tracepb.Value{Kind: &tracepb.Value_MapValue{MapValue: &tracepb.ValueMap{Fields: fields}}}, nil
+	}
+	return nil, fmt.Errorf("unexpected JSON value %T", v)
+}
+
+func protoFields(m map[string]interface{}) (map[string]*tracepb.Value, error) {
+	fields := make(map[string]*tracepb.Value, len(m))
+	for key, v := range m {
+		value, err := protoValue(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = value
+	}
+	return fields, nil
+}
+
+// stageValuesProto converts the values of a stage to those of trace.proto
+// through JSON, so they are the same as in the other formats.
+func stageValuesProto(values map[string]interface{}) (map[string]*tracepb.Value, error) {
+	b, err := json.Marshal(protoValues(values))
+	if err != nil {
+		return nil, err
+	}
+	var decoded map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return protoFields(decoded)
+}
+
+// resultProto converts result to the message of runID.
+func resultProto(runID string, result *RequestResult) (*tracepb.Result, error) {
+	m := &tracepb.Result{
+		SchemaVersion: schemaVersion,
+		RunId:         runID,
+		Method:        result.Method,
+		Url:           result.URL,
+		StartUnixNano: result.Start.UnixNano(),
+		Status:        int32(result.Status),
+		Proto:         result.Proto,
+		Error:         result.Error,
+		ErrorCategory: result.ErrorCategory,
+		RemoteAddr:    result.RemoteAddr,
+		DurationsNs:   make(map[string]int64, len(result.Durations)),
+		SessionId:     result.SessionID,
+		Step:          int32(result.Step),
+	}
+	for name, d := range result.Durations {
+		m.DurationsNs[name] = int64(d)
+	}
+	for _, stage := range result.Stages {
+		values, err := stageValuesProto(stage.Values)
+		if err != nil {
+			return nil, err
+		}
+		m.Stages = append(m.Stages, &tracepb.Stage{
+			Name:     stage.Name,
+			OffsetNs: int64(stage.Time.Sub(result.Start)),
+			Values:   values,
+		})
+	}
+	for _, attempt := range result.Attempts {
+		a, err := resultProto(runID, attempt)
+		if err != nil {
+			return nil, err
+		}
+		m.Attempts = append(m.Attempts, a)
+	}
+	return m, nil
+}
+
+// ProtobufExporter appends every result to a file as a length-delimited
+// Result message of trace.proto, for archives too large for JSON.
+type ProtobufExporter struct {
+	f *os.File
+}
+
+func NewProtobufExporter(path string) (*ProtobufExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtobufExporter{f: f}, nil
+}
+
+func (e *ProtobufExporter) Export(runID string, result *RequestResult) error {
+	m, err := resultProto(runID, result)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if _, err := protodelim.MarshalTo(&b, m); err != nil {
+		return err
+	}
+	// In one write, as a message cut short would make the rest of the file
+	// unreadable.
+	_, err = e.f.Write(b.Bytes())
+	return err
+}
+
+func (e *ProtobufExporter) Close() error {
+	return e.f.Close()
+}
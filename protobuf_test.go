@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+
+	"pcap/tracepb"
+)
+
+// TestProtobufExporterRoundTrip exports results to a file and reads them
+// back with the generated types.
+func TestProtobufExporterRoundTrip(t *testing.T) {
+	start := time.Now()
+	result := &RequestResult{
+		Method:     "GET",
+		URL:        "https://example.com/",
+		Start:      start,
+		Status:     200,
+		Proto:      "HTTP/2.0",
+		RemoteAddr: "192.0.2.1:443",
+		SessionID:  "session",
+		Step:       2,
+		Durations:  map[string]time.Duration{"connect": 3 * time.Millisecond, "total": 10 * time.Millisecond},
+		Stages: []Stage{
+			{Name: "Request", Time: start, Values: map[string]interface{}{"url": "https://example.com/", "seed": int64(-7)}},
+			{Name: "TLSHandshakeDone", Time: start.Add(5 * time.Millisecond), Values: map[string]interface{}{
+				"state":     tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "example.com"},
+				"didResume": true,
+				"error":     nil,
+				"ratio":     0.5,
+				"addrs":     []string{"192.0.2.1", "192.0.2.2"},
+			}},
+		},
+		Attempts: []*RequestResult{{
+			Method: "GET",
+			URL:    "https://example.com/",
+			Start:  start.Add(-time.Second),
+			Error:  "connection reset",
+			Stages: []Stage{{Name: "Request", Time: start.Add(-time.Second)}},
+		}},
+	}
+
+	path := filepath.Join(t.TempDir(), "results.pb")
+	exporter, err := NewProtobufExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := exporter.Export("run", result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := resultProto("run", result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var got []*tracepb.Result
+	for {
+		m := &tracepb.Result{}
+		if err := protodelim.UnmarshalFrom(r, m); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+	if len(got) != 2 {
+		t.Fatalf("read %d results, want 2", len(got))
+	}
+	if !proto.Equal(got[1], want) {
+		t.Errorf("read %v, want %v", got[1], want)
+	}
+
+	m := got[0]
+	if m.GetStatus() != 200 || m.GetStep() != 2 || m.GetDurationsNs()["connect"] != int64(3*time.Millisecond) {
+		t.Errorf("result fields %v", m)
+	}
+	if len(m.GetAttempts()) != 1 || m.GetAttempts()[0].GetError() != "connection reset" {
+		t.Errorf("attempts %v", m.GetAttempts())
+	}
+	stages := m.GetStages()
+	if len(stages) != 2 || stages[0].GetOffsetNs() != 0 || stages[1].GetOffsetNs() != int64(5*time.Millisecond) {
+		t.Fatalf("stages %v", stages)
+	}
+	if seed := stages[0].GetValues()["seed"]; seed.GetIntValue() != -7 {
+		t.Errorf("seed %v, want the int -7", seed)
+	}
+	values := stages[1].GetValues()
+	if !values["didResume"].GetBoolValue() || values["ratio"].GetDoubleValue() != 0.5 {
+		t.Errorf("values %v", values)
+	}
+	if values["error"].GetKind() != nil {
+		t.Errorf("null error is %v, want no kind", values["error"])
+	}
+	if addrs := values["addrs"].GetListValue().GetValues(); len(addrs) != 2 || addrs[1].GetStringValue() != "192.0.2.2" {
+		t.Errorf("addrs %v", addrs)
+	}
+	state := values["state"].GetMapValue().GetFields()
+	if state["version"].GetStringValue() != "TLS 1.3" || state["serverName"].GetStringValue() != "example.com" {
+		t.Errorf("TLS state %v", state)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyConnectResponse records the answer of the proxy to the CONNECT of an
+// HTTPS request in a ProxyConnect stage. Through an HTTPS proxy, the TLS
+// handshakes before it are with the proxy and those after with the origin,
+// inside the tunnel.
+func proxyConnectResponse(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+	if trace := bufferedClientTraceFrom(ctx); trace != nil {
+		trace.proxyConnected.Store(true)
+		trace.add("ProxyConnect", map[string]interface{}{
+			"proxy":  proxyURL.Redacted(),
+			"target": connectReq.Host,
+			"status": connectRes.StatusCode,
+		})
+	}
+	return nil
+}
+
+// proxyTunnelDial connects through the proxy of the request with a CONNECT
+// of its own instead of the transport's, which only knows Basic: a proxy that
+// challenges with NTLM or Negotiate gets the NTLM handshake, with the
+// credentials of the proxy URL, on the connection it challenged. Kerberos
+// isn't supported; Negotiate is answered with NTLM, which SPNEGO accepts.
+func proxyTunnelDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		trace := bufferedClientTraceFrom(ctx)
+		if trace == nil || trace.proxyURL == nil {
+			return dial(ctx, network, addr)
+		}
+		proxyURL := trace.proxyURL
+		conn, scheme, status, err := connectProxy(ctx, dial, network, proxyURL, addr)
+		if err == nil {
+			// Only a tunnel makes the TLS handshakes after it the origin's.
+			trace.proxyConnected.Store(true)
+		}
+		values := map[string]interface{}{
+			"proxy":      proxyURL.Redacted(),
+			"target":     addr,
+			"status":     status,
+			"authScheme": scheme,
+		}
+		if scheme == "Negotiate" {
+			values["mechanism"] = "NTLM"
+		}
+		trace.add("ProxyConnect", values)
+		return conn, err
+	}
+}
+
+// connectProxy opens a tunnel to addr through proxyURL and returns it with
+// the auth scheme it took, "none" when the proxy didn't ask, and the last
+// status of the proxy.
+func connectProxy(ctx context.Context, dial dialFunc, network string, proxyURL *url.URL, addr string) (net.Conn, string, int, error) {
+	conn, br, err := dialProxy(ctx, dial, network, proxyURL)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	resp, err := proxyConnect(conn, br, addr, "")
+	if err != nil {
+		conn.Close()
+		return nil, "", 0, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return conn, "none", resp.StatusCode, nil
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		conn.Close()
+		return nil, "none", resp.StatusCode, fmt.Errorf("proxy answered CONNECT with %s", resp.Status)
+	}
+
+	scheme := proxyAuthScheme(resp.Header.Values("Proxy-Authenticate"))
+	user := proxyURL.User.Username()
+	password, _ := proxyURL.User.Password()
+	if scheme == "" || user == "" {
+		conn.Close()
+		return nil, "none", resp.StatusCode, errors.New("proxy authentication required, with NTLM, Negotiate or Basic and the credentials in the proxy URL")
+	}
+	if resp.Close {
+		// The handshake has to be on one connection.
+		conn.Close()
+		if conn, br, err = dialProxy(ctx, dial, network, proxyURL); err != nil {
+			return nil, scheme, 0, err
+		}
+	}
+
+	if scheme == "Basic" {
+		resp, err = proxyConnect(conn, br, addr, "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	} else {
+		resp, err = proxyConnect(conn, br, addr, scheme+" "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+		if err == nil && resp.StatusCode == http.StatusProxyAuthRequired {
+			var challenge *ntlmChallenge
+			challenge, err = proxyNTLMChallenge(scheme, resp.Header.Values("Proxy-Authenticate"))
+			var msg []byte
+			if err == nil {
+				msg, err = ntlmAuthenticate(challenge, user, password)
+			}
+			if err == nil {
+				resp, err = proxyConnect(conn, br, addr, scheme+" "+base64.StdEncoding.EncodeToString(msg))
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, scheme, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, scheme, resp.StatusCode, fmt.Errorf("proxy answered CONNECT with %s after %s authentication", resp.Status, scheme)
+	}
+	return conn, scheme, resp.StatusCode, nil
+}
+
+// dialProxy connects to the proxy, over TLS for an HTTPS proxy.
+func dialProxy(ctx context.Context, dial dialFunc, network string, proxyURL *url.URL) (net.Conn, *bufio.Reader, error) {
+	port := proxyURL.Port()
+	if port == "" {
+		port = "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := dial(ctx, network, net.JoinHostPort(proxyURL.Hostname(), port))
+	if err != nil {
+		return nil, nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("proxy: %w", err)
+		}
+		conn = tlsConn
+	}
+	return conn, bufio.NewReader(conn), nil
+}
+
+// proxyConnect sends a CONNECT to addr with the Proxy-Authorization auth, if
+// any, and reads the answer, its body included so the connection can carry
+// on with the handshake.
+func proxyConnect(conn net.Conn, br *bufio.Reader, addr, auth string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}
+	return resp, nil
+}
+
+// proxyAuthScheme picks the scheme to answer the challenges with: NTLM over
+// Negotiate, which is answered with NTLM anyway, over Basic.
+func proxyAuthScheme(challenges []string) string {
+	offered := map[string]bool{}
+	for _, challenge := range challenges {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		offered[strings.ToLower(scheme)] = true
+	}
+	for _, scheme := range []string{"NTLM", "Negotiate", "Basic"} {
+		if offered[strings.ToLower(scheme)] {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// proxyNTLMChallenge returns the NTLM challenge of scheme among challenges.
+func proxyNTLMChallenge(scheme string, challenges []string) (*ntlmChallenge, error) {
+	for _, challenge := range challenges {
+		name, token, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		if !strings.EqualFold(name, scheme) || token == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+		if err != nil {
+			return nil, fmt.Errorf("ntlm: %w", err)
+		}
+		return parseNTLMChallenge(b)
+	}
+	return nil, fmt.Errorf("proxy sent no %s challenge", scheme)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ntlmProxy is a proxy answering CONNECT with the NTLM handshake of scheme
+// on the connection, then a tunnel answering ping with pong.
+type ntlmProxy struct {
+	scheme string
+
+	mu         sync.Mutex
+	challenges map[string][]byte // by remote address
+}
+
+func (p *ntlmProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), p.scheme+" ")
+	msg, err := base64.StdEncoding.DecodeString(token)
+	if !ok || err != nil || len(msg) < 12 {
+		w.Header().Set("Proxy-Authenticate", p.scheme)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch msg[8] {
+	case 1:
+		challenge := ntlmTestChallenge(true)
+		p.challenges[r.RemoteAddr] = challenge
+		w.Header().Set("Proxy-Authenticate", p.scheme+" "+base64.StdEncoding.EncodeToString(challenge))
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	case 3:
+		// The challenge of another connection fails the handshake.
+		challenge := p.challenges[r.RemoteAddr]
+		if challenge == nil || verifyNTLMAuthenticate(challenge, msg, "Domain", "User", "Password") != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+			rw.Flush()
+			if line, _ := rw.ReadString('\n'); line == "ping\n" {
+				rw.WriteString("pong\n")
+				rw.Flush()
+			}
+		}()
+	}
+}
+
+func TestProxyTunnelDialNTLM(t *testing.T) {
+	tests := []struct {
+		scheme, password string
+		wantStatus       int
+	}{
+		{"NTLM", "Password", http.StatusOK},
+		{"Negotiate", "Password", http.StatusOK},
+		{"NTLM", "wrong", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.scheme+" "+test.password, func(t *testing.T) {
+			proxy := httptest.NewServer(&ntlmProxy{scheme: test.scheme, challenges: map[string][]byte{}})
+			defer proxy.Close()
+			proxyURL, err := url.Parse(proxy.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxyURL.User = url.UserPassword(`Domain\User`, test.password)
+
+			trace := NewBufferedClientTrace(nil)
+			trace.proxyURL = proxyURL
+			ctx := withBufferedClientTrace(context.Background(), trace)
+			dial := proxyTunnelDial((&net.Dialer{}).DialContext)
+			conn, err := dial(ctx, "tcp", "origin.example:443")
+			stages := trace.Finish()
+
+			if test.wantStatus == http.StatusOK {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				if _, err := conn.Write([]byte("ping\n")); err != nil {
+					t.Fatal(err)
+				}
+				if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "pong\n" {
+					t.Errorf("tunnel answered %q, %v, want pong", line, err)
+				}
+			} else if err == nil {
+				conn.Close()
+				t.Fatal("tunnel opened with the wrong password")
+			}
+			if connected := trace.proxyConnected.Load(); connected != (test.wantStatus == http.StatusOK) {
+				t.Errorf("proxyConnected = %v with status %d", connected, test.wantStatus)
+			}
+
+			// The handshake is on the one connection to the proxy.
+			var names []string
+			for _, stage := range stages {
+				names = append(names, stage.Name)
+			}
+			if got := strings.Join(names, ","); got != "ConnectStart,ConnectDone,ProxyConnect" {
+				t.Fatalf("stages = %s, want one connection then ProxyConnect", got)
+			}
+			values := stages[2].Values
+			if values["status"] != test.wantStatus || values["authScheme"] != test.scheme {
+				t.Errorf("ProxyConnect = %v, want status %d with %s", values, test.wantStatus, test.scheme)
+			}
+			if strings.Contains(values["proxy"].(string), test.password) {
+				t.Errorf("ProxyConnect records the password: %v", values["proxy"])
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// rawHeadersConn tees the header block of every request written on a TLS
+// connection, as the bytes went on the wire rather than the normalized
+// WriteHeaderField view, into a RawRequestHeaders stage of the request. The
+// requests being bodiless GETs, a block ends at the first empty line and the
+// next write starts the one of the next request.
+type rawHeadersConn struct {
+	*tls.Conn
+	limit int
+	trace func() *BufferedClientTrace
+
+	mu        sync.Mutex
+	block     bytes.Buffer
+	size      int
+	truncated bool
+	// last are the last bytes of the block, for an empty line split across
+	// writes.
+	last []byte
+}
+
+func (c *rawHeadersConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for written := b[:n]; len(written) > 0; {
+		chunk := written
+		end := bytes.Index(append(c.last, written...), []byte("\r\n\r\n"))
+		if end >= 0 {
+			chunk = written[:end+4-len(c.last)]
+		}
+		written = written[len(chunk):]
+
+		c.size += len(chunk)
+		if room := c.limit - c.block.Len(); len(chunk) > room {
+			c.block.Write(chunk[:room])
+			c.truncated = true
+		} else {
+			c.block.Write(chunk)
+		}
+		c.last = append(c.last, chunk...)
+		if len(c.last) > 3 {
+			c.last = append([]byte(nil), c.last[len(c.last)-3:]...)
+		}
+		if end >= 0 {
+			c.flush()
+		}
+	}
+
+	return n, err
+}
+
+func (c *rawHeadersConn) flush() {
+	if t := c.trace(); t != nil {
+		t.add("RawRequestHeaders", map[string]interface{}{
+			"raw":       redactRawHeaders(c.block.Bytes()),
+			"size":      c.size,
+			"truncated": c.truncated,
+		})
+	}
+	c.block.Reset()
+	c.size = 0
+	c.truncated = false
+	c.last = nil
+}
+
+// redactRawHeaders replaces the values of sensitive header lines, keeping the
+// rest of the block byte for byte.
+func redactRawHeaders(block []byte) string {
+	lines := bytes.Split(block, []byte("\r\n"))
+	for i, line := range lines {
+		key, _, ok := bytes.Cut(line, []byte(":"))
+		if i > 0 && ok && sensitiveHeaders[http.CanonicalHeaderKey(string(bytes.TrimSpace(key)))] {
+			lines[i] = append(key, ": [REDACTED]"...)
+		}
+	}
+	return string(bytes.Join(lines, []byte("\r\n")))
+}
+
+// rawHeadersDialTLS dials TLS connections that record the raw request
+// headers, up to limit bytes each. The handshake is left to the transport,
+// which still fires the TLS trace callbacks on its own.
+func rawHeadersDialTLS(dial dialFunc, config *tls.Config, limit int, trace func() *BufferedClientTrace) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := config.Clone()
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			cfg.ServerName = host
+		}
+		return &rawHeadersConn{Conn: tls.Client(conn, cfg), limit: limit, trace: trace}, nil
+	}
+}
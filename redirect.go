@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errHTTPDowngrade fails a request redirected from https to http with
+// --allow-http-downgrade=false.
+var errHTTPDowngrade = errors.New("redirected from https to http")
+
+// maxRedirects is the limit of the default redirect policy of the client.
+const maxRedirects = 10
+
+// checkRedirect is the redirect policy of the client: that of net/http, plus
+// an HTTPDowngrade stage when a redirect goes from https to http, with the
+// whole chain so far as evidence of a misconfigured server or of SSL
+// stripping.
+func checkRedirect(allowDowngrade bool) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New("stopped after 10 redirects")
+		}
+		from := via[len(via)-1].URL
+		if from.Scheme != "https" || req.URL.Scheme != "http" {
+			return nil
+		}
+		chain := make([]string, 0, len(via)+1)
+		for _, r := range via {
+			chain = append(chain, r.URL.Redacted())
+		}
+		chain = append(chain, req.URL.Redacted())
+		values := map[string]interface{}{
+			"from":    from.Redacted(),
+			"to":      req.URL.Redacted(),
+			"chain":   chain,
+			"allowed": allowDowngrade,
+		}
+		if req.Response != nil {
+			values["status"] = req.Response.StatusCode
+		}
+		if trace := bufferedClientTraceFrom(req.Context()); trace != nil {
+			trace.add("HTTPDowngrade", values)
+		}
+		if !allowDowngrade {
+			return errHTTPDowngrade
+		}
+		return nil
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapConn is a TCP connection of a capture, the client being the side that
+// sent the SYN. Its stages carry the names of the httptrace callbacks they
+// correspond to, so the phases are computed the same way as for a request.
+type pcapConn struct {
+	client, server string
+	serverIP       net.IP
+	stages         []Stage
+	seen           map[string]bool
+
+	tls bool
+	// inflight are the segments of each side not acked yet and delivered
+	// the largest packet of each side acked, see onSegment.
+	inflight  map[string]map[uint32]*segment
+	delivered map[string]int
+	// iface is the interface of the current packet, "" when the capture
+	// doesn't name it, and ifaces all those the connection was seen on.
+	iface  string
+	ifaces []string
+}
+
+func (c *pcapConn) add(name string, t time.Time, values map[string]interface{}) {
+	if c.seen[name] {
+		return
+	}
+	c.seen[name] = true
+	if c.iface != "" {
+		values["interface"] = c.iface
+	}
+	c.stages = append(c.stages, Stage{Name: name, Time: t, Values: values})
+}
+
+// onPayload follows the exchange the way --tls-timing does: the ClientHello
+// starts the handshake, the first server flight is the ServerHello and the
+// next client flight finishes it. Without TLS the first lines of the request
+// and the response are recorded.
+func (c *pcapConn) onPayload(t time.Time, fromClient bool, payload []byte) {
+	if fromClient {
+		switch {
+		case !c.seen["TLSHandshakeStart"] && !c.seen["WroteRequest"] && isClientHello(payload):
+			c.tls = true
+			c.add("TLSHandshakeStart", t, map[string]interface{}{})
+		case c.tls && c.seen["TLSServerHelloReceived"] && !c.seen["TLSHandshakeDone"]:
+			c.add("TLSHandshakeDone", t, map[string]interface{}{"approximate": true})
+		case c.tls && c.seen["TLSHandshakeDone"]:
+			c.add("WroteRequest", t, map[string]interface{}{})
+		case !c.tls:
+			c.add("WroteRequest", t, map[string]interface{}{"requestLine": firstLine(payload)})
+		}
+		return
+	}
+
+	switch {
+	case c.tls && !c.seen["TLSServerHelloReceived"]:
+		c.add("TLSServerHelloReceived", t, map[string]interface{}{})
+	case c.seen["WroteRequest"] && !c.tls:
+		c.add("GotFirstResponseByte", t, map[string]interface{}{"statusLine": firstLine(payload)})
+	case c.seen["WroteRequest"]:
+		c.add("GotFirstResponseByte", t, map[string]interface{}{})
+	}
+}
+
+// isClientHello reports whether payload starts with a TLS handshake record
+// holding a ClientHello.
+func isClientHello(payload []byte) bool {
+	return len(payload) > 5 && payload[0] == 0x16 && payload[5] == 0x01
+}
+
+func firstLine(payload []byte) string {
+	line, _, _ := bytes.Cut(payload, []byte("\r\n"))
+	if len(line) > 200 {
+		line = line[:200]
+	}
+	return string(line)
+}
+
+type dnsLookup struct {
+	name       string
+	start, end time.Time
+	answers    []net.IP
+}
+
+// pcapReport holds the connections and DNS lookups of a capture.
+type pcapReport struct {
+	conns   map[string]*pcapConn
+	order   []*pcapConn
+	queries map[uint16]*dnsLookup
+	lookups []*dnsLookup
+	// truncated is set when the capture ends in the middle of a packet, as
+	// that of a capture killed while writing does.
+	truncated bool
+}
+
+func connKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+// onPacket follows packet, captured on the interface iface.
+func (r *pcapReport) onPacket(packet gopacket.Packet, iface string) {
+	t := packet.Metadata().Timestamp
+	var src, dst net.IP
+	var size int
+	switch network := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst, size = network.SrcIP, network.DstIP, int(network.Length)
+	case *layers.IPv6:
+		src, dst, size = network.SrcIP, network.DstIP, int(network.Length)+40
+	default:
+		return
+	}
+
+	if dns, ok := packet.Layer(layers.LayerTypeDNS).(*layers.DNS); ok {
+		r.onDNS(t, dns)
+		return
+	}
+	if r.onICMP(t, packet) {
+		return
+	}
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return
+	}
+
+	from := net.JoinHostPort(src.String(), fmt.Sprint(uint16(tcp.SrcPort)))
+	to := net.JoinHostPort(dst.String(), fmt.Sprint(uint16(tcp.DstPort)))
+	key := connKey(from, to)
+	conn := r.conns[key]
+	if tcp.SYN && !tcp.ACK && conn == nil {
+		conn = &pcapConn{
+			client: from, server: to, serverIP: dst, seen: map[string]bool{}, iface: iface,
+			inflight: map[string]map[uint32]*segment{}, delivered: map[string]int{},
+		}
+		r.conns[key] = conn
+		r.order = append(r.order, conn)
+		conn.add("ConnectStart", t, map[string]interface{}{"addr": to})
+	}
+	if conn == nil {
+		return // the capture started after the handshake
+	}
+	conn.iface = iface
+	if iface != "" && !slices.Contains(conn.ifaces, iface) {
+		conn.ifaces = append(conn.ifaces, iface)
+	}
+
+	fromClient := from == conn.client
+	side := "server"
+	if fromClient {
+		side = "client"
+	}
+	switch {
+	case tcp.SYN && tcp.ACK && !fromClient:
+		conn.add("ConnectDone", t, map[string]interface{}{"addr": to})
+	case tcp.RST:
+		conn.add("ConnectionReset", t, map[string]interface{}{"from": side, "seq": tcp.Seq})
+	case tcp.FIN:
+		conn.add("ConnectionClosed", t, map[string]interface{}{"from": side})
+	}
+	if tcp.ACK {
+		peer := "client"
+		if fromClient {
+			peer = "server"
+		}
+		conn.onAck(peer, tcp.Ack)
+	}
+	if len(tcp.Payload) > 0 {
+		conn.onSegment(t, side, tcp.Seq, len(tcp.Payload), size)
+		conn.onPayload(t, fromClient, tcp.Payload)
+	}
+}
+
+func (r *pcapReport) onDNS(t time.Time, dns *layers.DNS) {
+	if !dns.QR {
+		if len(dns.Questions) > 0 {
+			r.queries[dns.ID] = &dnsLookup{name: string(dns.Questions[0].Name), start: t}
+		}
+		return
+	}
+	lookup, ok := r.queries[dns.ID]
+	if !ok {
+		return
+	}
+	delete(r.queries, dns.ID)
+	lookup.end = t
+	for _, answer := range dns.Answers {
+		if answer.IP != nil {
+			lookup.answers = append(lookup.answers, answer.IP)
+		}
+	}
+	r.lookups = append(r.lookups, lookup)
+}
+
+// addLookups adds the last DNS lookup that answered the server address of
+// every connection before it started.
+func (r *pcapReport) addLookups() {
+	for _, conn := range r.order {
+		start := conn.stages[0].Time
+		var found *dnsLookup
+		for _, lookup := range r.lookups {
+			if lookup.end.After(start) {
+				continue
+			}
+			for _, ip := range lookup.answers {
+				if ip.Equal(conn.serverIP) {
+					found = lookup
+				}
+			}
+		}
+		if found == nil {
+			continue
+		}
+		conn.add("DNSStart", found.start, map[string]interface{}{"host": found.name})
+		conn.add("DNSDone", found.end, map[string]interface{}{"host": found.name})
+		sort.SliceStable(conn.stages, func(i, j int) bool {
+			return conn.stages[i].Time.Before(conn.stages[j].Time)
+		})
+	}
+}
+
+func readPcap(path string) (*pcapReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// pcapng files start with a section header block, pcap ones with a
+	// magic number of either byte order.
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	var source *gopacket.PacketSource
+	// ifaceName names the interface of a packet, as pcapng files can hold
+	// several, such as those captured on more than one interface.
+	ifaceName := func(gopacket.Packet) string { return "" }
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		source = gopacket.NewPacketSource(ng, ng.LinkType())
+		ifaceName = func(packet gopacket.Packet) string {
+			intf, err := ng.Interface(packet.Metadata().InterfaceIndex)
+			if err != nil {
+				return ""
+			}
+			return intf.Name
+		}
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		source = gopacket.NewPacketSource(pr, pr.LinkType())
+	}
+
+	report := &pcapReport{
+		conns:   map[string]*pcapConn{},
+		queries: map[uint16]*dnsLookup{},
+	}
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			report.truncated = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.onPacket(packet, ifaceName(packet))
+	}
+	report.addLookups()
+
+	return report, nil
+}
+
+func writeReport(w io.Writer, report *pcapReport) {
+	for i, conn := range report.order {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		proto := "tcp"
+		if conn.tls {
+			proto = "tls"
+		}
+		if len(conn.ifaces) > 0 {
+			proto += " on " + strings.Join(conn.ifaces, ",")
+		}
+		fmt.Fprintf(w, "%s -> %s (%s)\n", conn.client, conn.server, proto)
+
+		keys := []string{"host", "requestLine", "statusLine", "from", "detail"}
+		if len(conn.ifaces) > 1 {
+			keys = append(keys, "interface")
+		}
+		start := conn.stages[0].Time
+		for _, stage := range conn.stages {
+			line := fmt.Sprintf("  %10s %s", "+"+stage.Time.Sub(start).Round(time.Microsecond).String(), stage.Name)
+			for _, key := range keys {
+				if v, ok := stage.Values[key]; ok {
+					line += fmt.Sprintf(" %v", v)
+				}
+			}
+			fmt.Fprintln(w, line)
+		}
+
+		durations := phaseDurations(conn.stages)
+		for _, name := range append(phaseNames(), "total") {
+			if d, ok := durations[name]; ok {
+				fmt.Fprintf(w, "  %-8s %12s\n", name, formatDuration(d, true))
+			}
+		}
+	}
+}
+
+func reportMain(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("Usage: go run . report <capture.pcap|capture.pcapng>")
+		return exitUsage
+	}
+
+	report, err := readPcap(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if report.truncated {
+		fmt.Println("the capture is truncated, reporting the packets before the cut")
+	}
+	if len(report.order) == 0 {
+		fmt.Println("no TCP connection with its handshake found")
+		return 0
+	}
+
+	writeReport(os.Stdout, report)
+	return 0
+}
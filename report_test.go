@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestReadPcapTruncated reads a capture cut in the middle of its last packet
+// and reports the packets before.
+func TestReadPcapTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(1600, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}
+	start := time.Now()
+	for i, tcp := range []*layers.TCP{
+		{SrcPort: 40000, DstPort: 80, SYN: true},
+		{SrcPort: 80, DstPort: 40000, SYN: true, ACK: true},
+		{SrcPort: 40000, DstPort: 80, ACK: true},
+	} {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		if tcp.SrcPort == 80 {
+			ip.SrcIP, ip.DstIP = server, client
+		}
+		if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+			t.Fatal(err)
+		}
+		eth := &layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp); err != nil {
+			t.Fatal(err)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+		if err := w.WritePacket(ci, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(info.Size() - 10); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	report, err := readPcap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.truncated {
+		t.Error("truncated capture not flagged")
+	}
+	if len(report.order) != 1 {
+		t.Fatalf("%d connections, want 1", len(report.order))
+	}
+	var names []string
+	for _, stage := range report.order[0].stages {
+		names = append(names, stage.Name)
+	}
+	if len(names) != 2 || names[0] != "ConnectStart" || names[1] != "ConnectDone" {
+		t.Errorf("stages = %v, want ConnectStart and ConnectDone", names)
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const targetURL = "https://update.traefik.io/repos/traefik/traefik/releases"
+
+// newClient creates the client of a request, or of every request with
+// --reuse-conn. Its TLS keys go to the key log of the current run and pin
+// mismatches to the trace of the current request.
+func (r *Runner) newClient() (*http.Client, error) {
+	currentTrace := func() *BufferedClientTrace {
+		return r.trace
+	}
+	tlsConfig := tls.Config{
+		KeyLogWriter:           r.keyLog,
+		ServerName:             r.cfg.TLSServerName,
+		Renegotiation:          renegotiationSupport[string(r.cfg.TLSRenegotiation)],
+		SessionTicketsDisabled: !r.cfg.SessionTickets,
+		ClientSessionCache:     r.sessionCache,
+	}
+	if r.cfg.PinSHA256 != nil {
+		tlsConfig.VerifyPeerCertificate = pinVerifier(r.cfg.PinSHA256, currentTrace)
+	}
+	if tlsConfig.Renegotiation != tls.RenegotiateNever {
+		tlsConfig.VerifyConnection = renegotiationVerifier(currentTrace)
+	}
+	if r.cfg.HTTP3 {
+		return r.newHTTP3Client(&tlsConfig)
+	}
+	transport := &http.Transport{
+		Proxy:                  http.ProxyFromEnvironment,
+		OnProxyConnectResponse: proxyConnectResponse,
+		TLSClientConfig:        &tlsConfig,
+		TLSHandshakeTimeout:    10 * time.Second,
+		IdleConnTimeout:        r.cfg.IdleConnTimeout,
+		MaxIdleConns:           r.cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:    r.cfg.MaxIdlePerHost,
+		MaxConnsPerHost:        r.cfg.MaxConnsPerHost,
+		DisableKeepAlives:      r.cfg.NoKeepAlive,
+		ResponseHeaderTimeout:  10 * time.Second,
+		ExpectContinueTimeout:  10 * time.Second,
+	}
+	dialer := newDialer()
+	dialer.Timeout = r.cfg.ConnectTimeout
+	if r.cfg.TCPKeepAlive.set {
+		r.cfg.TCPKeepAlive.apply(dialer)
+	}
+	if r.cfg.TraceDNSServers || r.cfg.DNSQueries {
+		dialer.Resolver = tracingResolver()
+	}
+	dial := dialer.DialContext
+	if r.cfg.HappyEyeballs {
+		dial = happyEyeballsDial(dialer, r.cfg.FallbackDelay)
+	}
+	if r.warmDNS != nil {
+		dial = r.warmDNS.dial(dial)
+	}
+	if len(r.cfg.ConnectTo) > 0 {
+		dial = connectToDial(dial, r.cfg.ConnectTo)
+	}
+	if r.cfg.TCPKeepAlive.set {
+		dial = keepAliveDial(dial, &r.cfg.TCPKeepAlive)
+	}
+	if r.cfg.ProxyNTLM {
+		// The tunnel is the dial's, the transport sees a direct connection.
+		transport.Proxy = nil
+		dial = proxyTunnelDial(dial)
+	}
+	if r.cfg.TLSTiming {
+		dial = handshakeTimingDial(dial)
+	}
+	transport.DialContext = dial
+	if r.cfg.RawHeaderBytes > 0 {
+		transport.DialTLSContext = rawHeadersDialTLS(dial, &tlsConfig, r.cfg.RawHeaderBytes, currentTrace)
+	}
+	if r.cfg.HTTP2 {
+		pool, err := configureHTTP2(transport)
+		if err != nil {
+			return nil, fmt.Errorf("configuring HTTP/2: %w", err)
+		}
+		r.h2Pool = pool
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}, nil
+}
+
+// doRequest does a single logical request of the loop, or the steps of the
+// --sequence, with a cookie jar of their own, until one fails. Every step is
+// exported as a result of the same session and the last one is returned. It
+// returns nil when a request couldn't be made at all.
+func (r *Runner) doRequest(logger *logrus.Logger, runID string, keyLogWriter io.Writer) *RequestResult {
+	if keyLogWriter == nil {
+		keyLogWriter = io.Discard
+	}
+	r.keyLog.set(keyLogWriter)
+	defer r.keyLog.set(io.Discard)
+
+	steps := []requestStep{{}}
+	if r.cfg.BodySize > 0 {
+		steps[0] = requestStep{Method: http.MethodPost, Body: r.body}
+	}
+	sessionID := ""
+	if len(r.sequence) > 0 {
+		steps = r.sequence
+		sessionID = newSessionID()
+		if !r.cfg.CookieJar {
+			r.jar, _ = cookiejar.New(nil)
+			defer func() {
+				r.jar = nil
+			}()
+		}
+	}
+
+	var results []*RequestResult
+	for i, step := range steps {
+		result := r.doStep(logger, step)
+		if result == nil {
+			r.export(logger, runID, results)
+			return nil
+		}
+		if sessionID != "" {
+			result.SessionID = sessionID
+			result.Step = i + 1
+		}
+		results = append(results, result)
+		if result.Error != "" || result.Status >= 400 || result.Slow {
+			break
+		}
+	}
+	last := results[len(results)-1]
+	ok := last.Error == ""
+	if len(r.cfg.ExpectErrors) > 0 {
+		ok = r.succeeded(last)
+	}
+	r.metrics.observeOutcome(ok)
+	r.metrics.observeResult(runID, last, ok)
+	r.export(logger, runID, results)
+	return last
+}
+
+// export exports the results of the steps of a request, once the files of
+// the run have their outcome.
+func (r *Runner) export(logger *logrus.Logger, runID string, results []*RequestResult) {
+	if r.afterRequest != nil {
+		for _, result := range results {
+			r.afterRequest(result)
+		}
+	}
+	if r.files != nil {
+		if err := r.files.setOutcome(runOutcome(results)); err != nil {
+			logger.WithError(err).Warn("Error moving the files of the run")
+		}
+	}
+	for _, result := range results {
+		if r.sampled(result) && (!r.cfg.OnlyErrors || r.stopsOrFails(result)) {
+			if len(r.cfg.StageNames) > 0 {
+				result = r.cfg.StageNames.renameResult(result)
+			}
+			if err := r.exporter.Export(runID, result); err != nil {
+				logger.WithError(err).Warn("Error exporting result")
+			}
+		}
+	}
+}
+
+// doStep does a traced request, tried again with a fresh connection up to
+// --retries-per-iteration times while it fails. The failed attempts are kept
+// in the result.
+func (r *Runner) doStep(logger *logrus.Logger, step requestStep) *RequestResult {
+	var attempts []*RequestResult
+	for {
+		result := r.attempt(logger, step, len(attempts)+1)
+		if result == nil {
+			return nil
+		}
+		if len(attempts) == 0 {
+			// Retries use a fresh connection on purpose.
+			r.checkReuse(logger, result)
+		}
+		if result.Error == "" || len(attempts) >= r.cfg.InnerRetries {
+			result.Attempts = attempts
+			return result
+		}
+
+		logger.WithError(errors.New(result.Error)).WithField("attempt", len(attempts)+1).Warn("Retrying the request with a fresh connection")
+		attempts = append(attempts, result)
+		if r.client != nil {
+			r.client.CloseIdleConnections()
+			if r.h2Pool != nil {
+				r.h2Pool.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// connPoolLimits are the limits of the connection pool set by flags, nil
+// when the transport keeps its defaults.
+func (r *Runner) connPoolLimits() map[string]int {
+	if r.cfg.MaxIdleConns == 0 && r.cfg.MaxIdlePerHost == 0 && r.cfg.MaxConnsPerHost == 0 {
+		return nil
+	}
+	return map[string]int{
+		"maxIdleConns":        r.cfg.MaxIdleConns,
+		"maxIdleConnsPerHost": r.cfg.MaxIdlePerHost,
+		"maxConnsPerHost":     r.cfg.MaxConnsPerHost,
+	}
+}
+
+// checkReuse marks result as NotReused, with --fail-on-no-reuse, when it got
+// a new connection although an earlier request already established one.
+func (r *Runner) checkReuse(logger *logrus.Logger, result *RequestResult) {
+	stage, ok := findStage(result.Stages, "GotConn")
+	if !ok || stage.Values["reused"] == true {
+		return
+	}
+	if r.connected && r.cfg.FailOnNoReuse {
+		result.NotReused = true
+		result.Stages = append(result.Stages, newStage("ConnectionNotReused", map[string]interface{}{}))
+		logger.Warn("Request opened a new connection instead of reusing the idle one")
+	}
+	r.connected = true
+}
+
+// sampled reports whether result is exported with --sample-rate N: the first
+// of every N requests, and every failed one.
+func (r *Runner) sampled(result *RequestResult) bool {
+	r.requests++
+	if r.cfg.SampleRate <= 1 || result.Error != "" || result.Status >= 400 {
+		return true
+	}
+	return (r.requests-1)%r.cfg.SampleRate == 0
+}
+
+// stopsOrFails reports whether result is exported with --only-errors: a
+// failure, or the request that stops the loop whatever its outcome, such as
+// the success of --until-success. The golden of --verify-against is only
+// compared later, so a mismatch alone doesn't count.
+func (r *Runner) stopsOrFails(result *RequestResult) bool {
+	switch {
+	case !r.succeeded(result), result.Slow, result.NotReused:
+		return true
+	case r.cfg.UntilSuccess:
+		return true
+	case r.cfg.StopWhen.alternatives != nil:
+		return r.cfg.StopWhen.match(result)
+	}
+	return false
+}
+
+// newTrace returns the trace of a request, the current one of the runner.
+func (r *Runner) newTrace() *BufferedClientTrace {
+	trace := NewBufferedClientTrace(r.verboseStage())
+	trace.traceNameservers = r.cfg.TraceDNSServers
+	trace.traceDNSQueries = r.cfg.DNSQueries
+	trace.errno = r.cfg.RecordErrno
+	trace.goroutineIDs = r.cfg.GoroutineIDs
+	trace.certificates = r.cfg.CertSummary || r.cfg.WarnCertExpiry > 0
+	r.trace = trace
+	return trace
+}
+
+// traceContext returns the context of a request, canceled with the loop or
+// when it goes over a --phase-budget or the --watchdog-timeout. stop
+// releases it.
+func (r *Runner) traceContext(logger *logrus.Logger, trace *BufferedClientTrace) (ctx context.Context, stop func()) {
+	ctx = r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(r.cfg.PhaseBudgets) == 0 && r.cfg.WatchdogTimeout == 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stops := []func(){func() { cancel(nil) }}
+	if len(r.cfg.PhaseBudgets) > 0 {
+		budgets := newBudgetEnforcer(r.cfg.PhaseBudgets, trace, cancel)
+		stops = append(stops, budgets.stop)
+		trace.onAdd = budgets.stage
+	}
+	if r.cfg.WatchdogTimeout > 0 {
+		abandon := r.abandon
+		if abandon == nil {
+			abandon = func(error) {}
+		}
+		stops = append(stops, startWatchdog(logger, trace, r.cfg.WatchdogTimeout, cancel, abandon).stop)
+	}
+	return ctx, func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+}
+
+// setError records err of the request of ctx in result, as a budget or
+// watchdog error when ctx was canceled for it.
+func setError(ctx context.Context, result *RequestResult, err error) {
+	result.Error = err.Error()
+	result.ErrorCategory = errorCategory(err)
+	var budgetErr *budgetExceededError
+	var watchdogErr *watchdogError
+	if errors.As(context.Cause(ctx), &budgetErr) {
+		result.Error = budgetErr.Error() + ": " + result.Error
+		result.ErrorCategory = "phase_budget"
+	} else if errors.As(context.Cause(ctx), &watchdogErr) {
+		result.Error = watchdogErr.Error() + ": " + result.Error
+		result.ErrorCategory = "watchdog"
+	}
+}
+
+// attempt does one traced request of step.
+func (r *Runner) attempt(logger *logrus.Logger, step requestStep, n int) *RequestResult {
+	client := r.client
+	if client == nil {
+		var err error
+		client, err = r.newClient()
+		if err != nil {
+			logger.WithError(err).Error("Error creating client")
+			return nil
+		}
+		if r.cfg.ReuseConn {
+			r.client = client
+		} else if c, ok := client.Transport.(io.Closer); ok {
+			// The UDP socket of --http3 outlives its connections.
+			defer c.Close()
+		}
+	}
+	client.Jar = r.jar
+	client.CheckRedirect = checkRedirect(r.cfg.AllowDowngrade)
+	if r.cfg.TCPOnly {
+		return r.probe(logger, client, step)
+	}
+
+	trace := r.newTrace()
+	ctx, stop := r.traceContext(logger, trace)
+	defer stop()
+	req, err := http.NewRequestWithContext(
+		withBufferedClientTrace(ctx, trace),
+		step.method(),
+		step.url(),
+		step.body())
+	if err != nil {
+		logger.WithError(err).Error("Error creating request")
+		return nil
+	}
+	addHeaders(req, r.headers)
+	addHeaders(req, step.Headers)
+	if r.cfg.HostHeader != "" {
+		req.Host = r.cfg.HostHeader
+	}
+	hostHeader := req.Host
+	if hostHeader == "" {
+		hostHeader = req.URL.Host
+	}
+	values := map[string]interface{}{
+		"url":         req.URL.String(),
+		"connectHost": req.URL.Host,
+		"hostHeader":  hostHeader,
+		"slept":       r.slept.String(),
+		"seed":        r.cfg.Seed,
+		"tsPrecision": string(r.cfg.TSPrecision),
+	}
+	if r.cfg.InnerRetries > 0 {
+		values["attempt"] = n
+	}
+	if len(r.sequence) > 0 {
+		values["method"] = req.Method
+		values["stepName"] = step.Name
+	}
+	if r.cfg.NoKeepAlive {
+		values["keepAlivesDisabled"] = true
+	}
+	if r.cfg.BodySize > 0 {
+		values["bodySize"] = r.cfg.BodySize
+		values["bodyFill"] = string(r.cfg.BodyFill)
+	}
+	if pool := r.connPoolLimits(); pool != nil {
+		values["connPool"] = pool
+	}
+	if proxyURL, _ := http.ProxyFromEnvironment(req); proxyURL != nil && !r.cfg.HTTP3 {
+		values["proxy"] = proxyURL.Redacted()
+		trace.proxyURL = proxyURL
+		if proxyURL.Scheme == "https" {
+			trace.httpsProxy = proxyURL.Host
+		}
+	}
+	var traceID, spanID string
+	if r.cfg.Traceparent {
+		var header string
+		header, traceID, spanID = traceparent(r.cfg.TraceID)
+		req.Header.Set("traceparent", header)
+		values["traceparent"] = header
+		values["traceID"] = traceID
+	}
+	// Started before its first stage, which the offsets of the protobuf
+	// format are from.
+	result := &RequestResult{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Start:   time.Now(),
+		TraceID: traceID,
+		SpanID:  spanID,
+	}
+	trace.add("Request", values)
+	if r.cfg.PrintCurl {
+		logger.WithField("curl", curlCommand(req, r.cfg)).Info("Equivalent curl command")
+	}
+
+	if r.cfg.TLSEarlyData {
+		req = earlyDataRequest(req)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		setError(ctx, result, err)
+		r.finish(logger, result, trace)
+		return result
+	}
+	defer resp.Body.Close()
+	var body *hashingBody
+	if r.cfg.RecordGolden != "" || r.golden != nil {
+		body = newHashingBody(resp.Body)
+		resp.Body = body
+	}
+	result.Status = resp.StatusCode
+	result.Proto = resp.Proto
+
+	negotiatedProtocol := ""
+	if resp.TLS != nil {
+		negotiatedProtocol = resp.TLS.NegotiatedProtocol
+	}
+	trace.add("Response", map[string]interface{}{
+		"status":             resp.StatusCode,
+		"proto":              resp.Proto,
+		"negotiatedProtocol": negotiatedProtocol,
+	})
+	if r.cfg.HonorRetryAfter {
+		r.retryAfter(logger, result, resp, trace)
+	}
+	if cookies := resp.Cookies(); r.jar != nil && len(cookies) > 0 {
+		names := make([]string, 0, len(cookies))
+		for _, cookie := range cookies {
+			names = append(names, cookie.Name)
+		}
+		trace.add("ResponseCookies", map[string]interface{}{
+			"names": names,
+		})
+	}
+	if len(r.cfg.ResponseHeaders) > 0 {
+		trace.add("ResponseHeaders", selectHeaders(resp.Header, r.cfg.ResponseHeaders))
+	}
+	if header := resp.Header.Values("Server-Timing"); r.cfg.ServerTiming && len(header) > 0 {
+		metrics, malformed := parseServerTiming(header)
+		values := map[string]interface{}{
+			"metrics": metrics,
+		}
+		if len(malformed) > 0 {
+			values["malformed"] = malformed
+		}
+		if traceID != "" {
+			// To find the trace of the server these timings are from.
+			values["traceID"] = traceID
+		}
+		trace.add("ServerTiming", values)
+	}
+	if name := r.cfg.CorrelationHdr; name != "" {
+		sent, received := req.Header.Get(name), resp.Header.Get(name)
+		trace.add("CorrelationID", map[string]interface{}{
+			"header":   name,
+			"sent":     sent,
+			"received": received,
+			"mismatch": sent != "" && received != "" && sent != received,
+		})
+	}
+
+	switch {
+	case r.cfg.CaptureBodyBytes > 0:
+		values := captureBody(resp, r.cfg.CaptureBodyBytes, r.cfg.MaxResponseSize)
+		trace.add("ResponseBody", values)
+		if r.cfg.ExpectSHA256 != nil {
+			sum, _ := hex.DecodeString(values["sha256"].(string))
+			var err error
+			if msg, ok := values["error"].(string); ok {
+				err = errors.New(msg)
+			}
+			checkBodySHA256(result, trace, r.cfg.ExpectSHA256, sum, values["size"].(int64), err)
+		}
+	case r.cfg.ExpectSHA256 != nil:
+		sum, size, err := bodySHA256(resp.Body)
+		checkBodySHA256(result, trace, r.cfg.ExpectSHA256, sum, size, err)
+	case !r.cfg.DrainBody:
+		// Closing the body unread usually closes an HTTP/1.1 connection
+		// instead of putting it back in the pool, unless the whole body was
+		// already buffered. HTTP/2 and HTTP/3 only reset the stream.
+		resp.Body.Close()
+		trace.add("BodyNotRead", map[string]interface{}{
+			"contentLength": resp.ContentLength,
+			"proto":         resp.Proto,
+		})
+		if resp.ProtoMajor == 1 {
+			logger.Info("Response body closed unread, the connection may not be reused")
+		}
+	default:
+		// Stopping short of the end closes the connection, like
+		// --drain-body=false.
+		maxSize := r.cfg.MaxResponseSize
+		if maxSize == 0 {
+			maxSize = -1
+		}
+		if _, exceeded, _ := drainBody(resp.Body, maxSize); exceeded {
+			trace.add("ResponseTruncated", map[string]interface{}{
+				"maxResponseSize": r.cfg.MaxResponseSize,
+				"contentLength":   resp.ContentLength,
+			})
+		}
+	}
+	if body != nil {
+		setExchange(result, req, resp, body)
+	}
+	// The body is read whatever the error, such as the watchdog cutting it.
+	var watchdogErr *watchdogError
+	if errors.As(context.Cause(ctx), &watchdogErr) {
+		result.Error = watchdogErr.Error() + " while reading the body"
+		result.ErrorCategory = "watchdog"
+	}
+	r.finish(logger, result, trace)
+
+	return result
+}
+
+func (r *Runner) finish(logger *logrus.Logger, result *RequestResult, trace *BufferedClientTrace) {
+	r.decideRetry(result, trace)
+	result.Stages = trace.Finish()
+	r.cfg.TSPrecision.roundStages(result)
+	result.RemoteAddr = remoteAddr(result.Stages)
+	result.TLSError = tlsError(result.Stages)
+	if stage, ok := findStage(result.Stages, "HTTPDowngrade"); ok {
+		logger.WithFields(logrus.Fields{
+			"from":  stage.Values["from"],
+			"to":    stage.Values["to"],
+			"chain": stage.Values["chain"],
+		}).Warn("HTTPS request redirected to HTTP")
+	}
+	if result.TLSError != "" && result.ErrorCategory == "other" {
+		// Such as a pin mismatch, returned as is by the handshake.
+		result.ErrorCategory = "tls"
+	}
+	if r.cfg.DiagOnFailure && diagCategories[result.ErrorCategory] {
+		result.Stages = append(result.Stages, tracerouteStage(result.Stages))
+	}
+	if r.cfg.CanonicalStages {
+		result.Stages = canonicalStages(result.Stages, r.cfg.Verbose)
+	}
+	if r.cfg.RelativeTime {
+		setRelativeTimes(result.Stages)
+	}
+	result.Durations = phaseDurations(result.Stages)
+	if r.cfg.PoolWait {
+		if d, ok := poolWait(result.Stages); ok {
+			result.Durations["poolwait"] = d
+			stage, _ := findStage(result.Stages, "GotConn")
+			stage.Values["poolWait"] = d.String()
+		}
+	}
+	if total := result.Durations["total"]; r.cfg.StopOnSlow > 0 && total > r.cfg.StopOnSlow {
+		result.Slow = true
+		durations := make(map[string]string, len(result.Durations))
+		for name, d := range result.Durations {
+			durations[name] = d.String()
+		}
+		result.Stages = append(result.Stages, newStage("SlowRequest", map[string]interface{}{
+			"threshold": r.cfg.StopOnSlow.String(),
+			"total":     total.String(),
+			"durations": durations,
+		}))
+		logger.WithFields(logrus.Fields{
+			"threshold": r.cfg.StopOnSlow.String(),
+			"durations": durations,
+		}).Warn("Request slower than --stop-on-slow")
+	}
+	r.verboseTotal(result.Durations)
+	if r.baseline != nil {
+		r.compareBaseline(logger, result)
+	}
+	r.metrics.observe(logger, result.Durations)
+	r.metrics.observeConn(result.Stages)
+	if stage, ok := findStage(result.Stages, "GotConn"); ok && r.cfg.NoKeepAlive && stage.Values["reused"] == true {
+		logger.Warn("Connection reused although keep-alives are disabled")
+	}
+	if stage, ok := findStage(result.Stages, "Certificate"); ok && r.cfg.WarnCertExpiry > 0 {
+		if notAfter := stage.Values["notAfter"].(time.Time); time.Until(notAfter) < r.cfg.WarnCertExpiry {
+			logger.WithFields(logrus.Fields{
+				"subject":  stage.Values["subject"],
+				"notAfter": notAfter,
+			}).Warn("Server certificate expires soon")
+		}
+	}
+}
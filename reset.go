@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptrace"
+	"time"
+)
+
+// addTCPReset adds a TCPReset stage to result for the first RST captured on
+// the connection of the request, with the side that sent it, its sequence
+// number and the last stage of the trace before it. httptrace alone can't
+// tell a reset from another failure.
+func addTCPReset(result *RequestResult, report *pcapReport) bool {
+	conn := requestConn(result.Stages, report)
+	if conn == nil {
+		return false
+	}
+	reset, ok := findStage(conn.stages, "ConnectionReset")
+	if !ok {
+		return false
+	}
+
+	afterStage := ""
+	for _, stage := range result.Stages {
+		if !stage.Time.After(reset.Time) {
+			afterStage = stage.Name
+		}
+	}
+	result.Stages = append(result.Stages, Stage{
+		Name: "TCPReset",
+		Time: reset.Time,
+		Values: map[string]interface{}{
+			"from":       reset.Values["from"],
+			"seq":        reset.Values["seq"],
+			"client":     conn.client,
+			"server":     conn.server,
+			"afterStage": afterStage,
+		},
+	})
+	return true
+}
+
+// requestConn finds the captured connection of a request: by its addresses
+// once it got one, else, such as when the handshake was reset, the one to the
+// same server whose SYN is the closest to a ConnectStart.
+func requestConn(stages []Stage, report *pcapReport) *pcapConn {
+	if stage, ok := findStage(stages, "GotConn"); ok {
+		if info, ok := stage.Values["GotConnInfo"].(httptrace.GotConnInfo); ok && info.Conn != nil {
+			return report.conns[connKey(info.Conn.LocalAddr().String(), info.Conn.RemoteAddr().String())]
+		}
+	}
+
+	var found *pcapConn
+	var best time.Duration
+	for _, stage := range stages {
+		if stage.Name != "ConnectStart" {
+			continue
+		}
+		for _, conn := range report.order {
+			if conn.server != stage.Values["addr"] {
+				continue
+			}
+			d := conn.stages[0].Time.Sub(stage.Time).Abs()
+			if found == nil || d < best {
+				found, best = conn, d
+			}
+		}
+	}
+	return found
+}
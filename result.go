@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http/httptrace"
+	"time"
+)
+
+// RequestResult is the outcome of one request of the loop.
+type RequestResult struct {
+	Method    string
+	URL       string
+	Start     time.Time
+	Stages    []Stage
+	Durations map[string]time.Duration
+	Status    int
+	Proto     string
+	Error     string
+	TLSError  string
+	// RemoteAddr is the address the request connected to, or last tried to
+	// when it failed to connect.
+	RemoteAddr string
+	// ErrorCategory is the errorCategory of Error.
+	ErrorCategory string
+	Retry         *RetryDecision
+	// RetryAfter is the delay the server asked for with --honor-retry-after.
+	RetryAfter time.Duration
+	// TraceID and SpanID are the IDs of the traceparent header sent with
+	// --inject-traceparent.
+	TraceID string
+	SpanID  string
+	// Attempts are the failed attempts before this one with
+	// --retries-per-iteration.
+	Attempts []*RequestResult
+	// SessionID and Step are the run of the --sequence the request belongs
+	// to and its number in it, from 1.
+	SessionID string
+	Step      int
+	// NotReused is set with --fail-on-no-reuse when the request opened a new
+	// connection although an earlier one had been established.
+	NotReused bool
+	// Slow is set with --stop-on-slow when the request took longer than the
+	// threshold.
+	Slow bool
+	// Exchange is set with --record-golden and --verify-against once a
+	// response was read.
+	Exchange *exchange
+}
+
+// remoteAddr returns the address of the connection a request got, or else
+// the last address it tried to connect to, "" when it didn't get that far.
+func remoteAddr(stages []Stage) string {
+	if stage, ok := findStage(stages, "GotConn"); ok {
+		if info, ok := stage.Values["GotConnInfo"].(httptrace.GotConnInfo); ok && info.Conn != nil {
+			return info.Conn.RemoteAddr().String()
+		}
+	}
+	addr := ""
+	for _, stage := range stages {
+		if stage.Name == "ConnectStart" {
+			addr, _ = stage.Values["addr"].(string)
+		}
+	}
+	return addr
+}
+
+func (res *RequestResult) durationsMs() map[string]float64 {
+	ms := make(map[string]float64, len(res.Durations))
+	for name, d := range res.Durations {
+		ms[name] = float64(d) / float64(time.Millisecond)
+	}
+	return ms
+}
+
+// record is the result as a single JSON object, as written by the ndjson and
+// kafka output formats.
+func (res *RequestResult) record(runID string) map[string]interface{} {
+	record := map[string]interface{}{
+		"schemaVersion": schemaVersion,
+		"runID":         runID,
+		"method":        res.Method,
+		"url":           res.URL,
+		"start":         res.Start,
+		"status":        res.Status,
+		"proto":         res.Proto,
+		"error":         res.Error,
+		"errorCategory": res.ErrorCategory,
+		"remoteAddr":    res.RemoteAddr,
+		"durationsMs":   res.durationsMs(),
+		"stages":        res.Stages,
+		"attempts":      res.attemptRecords(),
+	}
+	if res.SessionID != "" {
+		record["sessionID"] = res.SessionID
+		record["step"] = res.Step
+	}
+	return record
+}
+
+// attemptRecords are the failed attempts of the result, nil when there were
+// none.
+func (res *RequestResult) attemptRecords() []map[string]interface{} {
+	if len(res.Attempts) == 0 {
+		return nil
+	}
+	records := make([]map[string]interface{}, 0, len(res.Attempts))
+	for _, attempt := range res.Attempts {
+		records = append(records, map[string]interface{}{
+			"start":       attempt.Start,
+			"error":       attempt.Error,
+			"durationsMs": attempt.durationsMs(),
+			"stages":      attempt.Stages,
+		})
+	}
+	return records
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRetryBackoff caps the exponential backoff between retries.
+const maxRetryBackoff = time.Minute
+
+// minUnmadeBackoff is the least the loop waits after a request that couldn't
+// be made, even with a --retry-backoff of zero.
+const minUnmadeBackoff = 100 * time.Millisecond
+
+type statusRange struct {
+	from, to int
+}
+
+// statusList is a comma-separated list of status codes and ranges, e.g.
+// "429,502-504".
+type statusList []statusRange
+
+func (l *statusList) String() string {
+	parts := make([]string, 0, len(*l))
+	for _, r := range *l {
+		if r.from == r.to {
+			parts = append(parts, strconv.Itoa(r.from))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r.from, r.to))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *statusList) Set(value string) error {
+	var list statusList
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		r := statusRange{}
+		var err error
+		if r.from, err = strconv.Atoi(from); err != nil {
+			return fmt.Errorf("invalid status %q", part)
+		}
+		r.to = r.from
+		if isRange {
+			if r.to, err = strconv.Atoi(to); err != nil || r.to < r.from {
+				return fmt.Errorf("invalid status range %q", part)
+			}
+		}
+		list = append(list, r)
+	}
+	*l = list
+	return nil
+}
+
+func (l statusList) contains(status int) bool {
+	for _, r := range l {
+		if status >= r.from && status <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+type RetryDecision struct {
+	Attempt int
+	Backoff time.Duration
+}
+
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	backoff := base
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
+// decideRetry records whether the response status of result is retryable
+// and counts consecutive retries.
+func (r *Runner) decideRetry(result *RequestResult, trace *BufferedClientTrace) {
+	if result.Status == 0 || !r.cfg.RetryOnStatus.contains(result.Status) {
+		r.retries = 0
+		return
+	}
+
+	r.retries++
+	result.Retry = &RetryDecision{
+		Attempt: r.retries,
+		Backoff: retryBackoff(r.cfg.RetryBackoff, r.retries),
+	}
+	trace.add("RetryDecision", map[string]interface{}{
+		"status":     result.Status,
+		"attempt":    result.Retry.Attempt,
+		"maxRetries": r.cfg.MaxRetries,
+		"backoff":    result.Retry.Backoff.String(),
+		"giveUp":     r.cfg.MaxRetries > 0 && result.Retry.Attempt > r.cfg.MaxRetries,
+	})
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given as
+// delta-seconds or as an HTTP-date, which is no delay once past.
+func parseRetryAfter(value string, now time.Time) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("negative Retry-After %q", value)
+		}
+		// The longest Duration rather than one that overflowed.
+		if seconds > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64, nil
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Retry-After %q, want seconds or an HTTP-date", value)
+	}
+	return max(date.Sub(now), 0).Round(time.Second), nil
+}
+
+// retryAfter records the Retry-After of a 429 or 503 response with
+// --honor-retry-after, for the loop to wait as long before the next request,
+// at most --max-retry-after.
+func (r *Runner) retryAfter(logger *logrus.Logger, result *RequestResult, resp *http.Response, trace *BufferedClientTrace) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return
+	}
+	delay, err := parseRetryAfter(value, time.Now())
+	if err != nil {
+		trace.add("RetryAfter", map[string]interface{}{
+			"header": value,
+			"error":  err.Error(),
+		})
+		return
+	}
+	values := map[string]interface{}{
+		"header": value,
+	}
+	if delay > r.cfg.MaxRetryAfter {
+		logger.WithFields(logrus.Fields{
+			"retryAfter": value,
+			"max":        r.cfg.MaxRetryAfter.String(),
+		}).Warn("Retry-After longer than --max-retry-after, waiting the max")
+		values["clampedFrom"] = delay.String()
+		delay = r.cfg.MaxRetryAfter
+	}
+	result.RetryAfter = delay
+	values["delay"] = delay.String()
+	trace.add("RetryAfter", values)
+}
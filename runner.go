@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of the program.
+const (
+	exitCountExhausted = 0  // --count requests done without reproducing
+	exitUsage          = 1  // bad arguments or start up failure
+	exitReproduced     = 2  // a connection error was found
+	exitInterrupted    = 3  // stopped by SIGINT or SIGTERM
+	exitRetriesGaveUp  = 4  // --max-retries consecutive retryable statuses
+	exitTLSError       = 5  // a TLS handshake failed with --abort-on-tls-error
+	exitNotReused      = 6  // a new connection was opened with --fail-on-no-reuse
+	exitNoSuccess      = 7  // --count requests done without one succeeding, with --until-success
+	exitSLOFailed      = 8  // --count requests done with a --slo target missed
+	exitGoldenMismatch = 9  // a response departed from the --verify-against golden
+	exitWatchdog       = 10 // a request stayed stuck after --watchdog-timeout canceled it
+)
+
+// Runner holds the state shared by every iteration of the request loop.
+type Runner struct {
+	cfg      *Config
+	metrics  *Metrics
+	logger   *logrus.Logger
+	logOut   *swapWriter
+	exporter Exporter
+
+	headers []string
+
+	// client is kept across requests with --reuse-conn, nil otherwise.
+	client *http.Client
+	// h2Pool is the HTTP/2 connection pool of the last client made with
+	// --http2, whose idle connections the client can't close by itself.
+	h2Pool *tracingConnPool
+	keyLog *swapWriter
+	// trace is the trace of the current request.
+	trace *BufferedClientTrace
+	// verboseDurations are the phase durations of the previous request
+	// printed by --verbose.
+	verboseDurations map[string]time.Duration
+	// sessionCache keeps TLS sessions across clients with --tls-session-cache.
+	sessionCache tls.ClientSessionCache
+	// sequence are the steps of --sequence, and jar the cookies of the
+	// current run of them or, with --cookie-jar, of the whole loop.
+	sequence []requestStep
+	jar      http.CookieJar
+	// body is the request body generated with --body-size.
+	body string
+	// warmDNS are the addresses of the target resolved with --warm-dns.
+	warmDNS *warmDNS
+
+	// files names the files of the current run.
+	files *runFiles
+
+	// ctx is the context of the loop, canceled by SIGINT and SIGTERM, that
+	// requests are made with so that they're canceled too.
+	ctx context.Context
+	// abandon cancels ctx for a request still stuck after the watchdog
+	// canceled it, for the loop to give up on the request and exit.
+	abandon context.CancelCauseFunc
+	// stopCapture stops the capture of the current request, for the loop to
+	// write it out when it abandons the request.
+	stopCapture atomic.Pointer[func()]
+	// slept is how long the loop waited before the current request.
+	slept time.Duration
+	// retries counts consecutive responses with a --retry-on-status status.
+	retries int
+	// requests counts the requests for --sample-rate.
+	requests int
+	// connected is set once a request got a connection, for
+	// --fail-on-no-reuse.
+	connected bool
+	// afterRequest, when set, completes the result of a request before it's
+	// exported, such as with the packets captured meanwhile.
+	afterRequest func(result *RequestResult)
+	// golden is the golden of --verify-against.
+	golden *golden
+	// baseline are the phase durations of --compare-baseline.
+	baseline map[string]time.Duration
+}
+
+func NewRunner(cfg *Config) (*Runner, error) {
+	if cfg.NoKeepAlive && cfg.ReuseConn {
+		return nil, errors.New("--no-keepalive and --reuse-conn exclude each other")
+	}
+	if cfg.RawHeaderBytes > 0 && cfg.HTTP2 {
+		return nil, errors.New("--raw-request-headers needs HTTP/1.1, not --http2")
+	}
+	if cfg.UntilSuccess && cfg.StopWhen.alternatives != nil {
+		return nil, errors.New("--until-success and --stop-when exclude each other")
+	}
+	if cfg.WarmDNS && cfg.HappyEyeballs {
+		return nil, errors.New("--warm-dns and --happy-eyeballs exclude each other")
+	}
+	if cfg.FailOnNoReuse && !cfg.ReuseConn {
+		return nil, errors.New("--fail-on-no-reuse needs --reuse-conn")
+	}
+	if !cfg.DrainBody && (cfg.CaptureBodyBytes > 0 || cfg.ExpectSHA256 != nil) {
+		return nil, errors.New("--capture-body-bytes and --expect-sha256 read the body, not --drain-body=false")
+	}
+	if !cfg.DrainBody && cfg.FailOnNoReuse {
+		return nil, errors.New("--fail-on-no-reuse needs the body drained, not --drain-body=false")
+	}
+	if len(cfg.SLOs) > 0 && cfg.Count == 0 {
+		return nil, errors.New("--slo needs --count")
+	}
+	if len(cfg.ExpectErrors) > 0 && cfg.StopWhen.alternatives != nil {
+		return nil, errors.New("--expect-error and --stop-when exclude each other")
+	}
+	if cfg.StopOnSlow > 0 && cfg.UntilSuccess {
+		return nil, errors.New("--stop-on-slow and --until-success exclude each other")
+	}
+	if len(cfg.SLOs) > 0 && cfg.UntilSuccess {
+		return nil, errors.New("--slo and --until-success exclude each other")
+	}
+	if cfg.BodySize < 0 {
+		return nil, errors.New("--body-size must not be negative")
+	}
+	if cfg.BodySize > 0 && cfg.Sequence != "" {
+		return nil, errors.New("--body-size and --sequence exclude each other")
+	}
+	if cfg.BodySize > 0 && cfg.RawHeaderBytes > 0 {
+		return nil, errors.New("--raw-request-headers only supports requests without a body, not --body-size")
+	}
+	if cfg.RecordGolden != "" && cfg.VerifyAgainst != "" {
+		return nil, errors.New("--record-golden and --verify-against exclude each other")
+	}
+	if (cfg.RecordGolden != "" || cfg.VerifyAgainst != "") && cfg.Sequence != "" {
+		return nil, errors.New("--record-golden and --verify-against check a single request, not --sequence")
+	}
+	if (cfg.RecordGolden != "" || cfg.VerifyAgainst != "") && !cfg.DrainBody {
+		return nil, errors.New("--record-golden and --verify-against hash the body, not --drain-body=false")
+	}
+	if cfg.ReportRoll && (cfg.ReportInterval <= 0 || cfg.LogFile == "") {
+		return nil, errors.New("--report-roll needs --report-interval and --log-file")
+	}
+	if cfg.LogLevelKey == "" || cfg.LogMsgKey == "" || cfg.LogTimeKey == "" {
+		return nil, errors.New("the JSON log field names must not be empty")
+	}
+	if cfg.LogLevelKey == cfg.LogMsgKey || cfg.LogLevelKey == cfg.LogTimeKey || cfg.LogMsgKey == cfg.LogTimeKey {
+		return nil, errors.New("the JSON log field names of the level, message and time must differ")
+	}
+	if cfg.DriftAlpha <= 0 || cfg.DriftAlpha > 1 {
+		// Out of (0,1] the variance of the averages goes negative.
+		return nil, errors.New("--drift-alpha must be in (0,1]")
+	}
+	if cfg.BaselineMultiple <= 0 {
+		return nil, errors.New("--baseline-multiple must be positive")
+	}
+	if cfg.GoldenTolerance < 0 {
+		return nil, errors.New("--golden-tolerance must not be negative")
+	}
+	if cfg.TCPOnly && (cfg.Sequence != "" || cfg.RecordGolden != "" || cfg.VerifyAgainst != "") {
+		return nil, errors.New("--tcp-only does no request, not --sequence, --record-golden nor --verify-against")
+	}
+	if cfg.MaxRetryAfter <= 0 {
+		return nil, errors.New("--max-retry-after must be positive")
+	}
+	if cfg.TLSEarlyData && !cfg.HTTP3 {
+		// crypto/tls has no API to send early data or to tell it was
+		// accepted; quic-go has both.
+		return nil, errors.New("--tls-early-data needs --http3: Go's crypto/tls client can't send TLS 1.3 early data (0-RTT) over TCP")
+	}
+	if cfg.HTTP3 {
+		// These dial, pool or trace TCP connections.
+		for _, other := range []struct {
+			name string
+			set  bool
+		}{
+			{"--http2", cfg.HTTP2},
+			{"--tls-timing", cfg.TLSTiming},
+			{"--raw-request-headers", cfg.RawHeaderBytes > 0},
+			{"--happy-eyeballs", cfg.HappyEyeballs},
+			{"--warm-dns", cfg.WarmDNS},
+			{"--connect-to", len(cfg.ConnectTo) > 0},
+			{"--tcp-keepalive", cfg.TCPKeepAlive.set},
+			{"--no-keepalive", cfg.NoKeepAlive},
+			{"--max-idle-conns", cfg.MaxIdleConns > 0},
+			{"--max-idle-conns-per-host", cfg.MaxIdlePerHost > 0},
+			{"--max-conns-per-host", cfg.MaxConnsPerHost > 0},
+			{"--proxy-ntlm", cfg.ProxyNTLM},
+			{"--tcp-only", cfg.TCPOnly},
+		} {
+			if other.set {
+				return nil, fmt.Errorf("--http3 and %s exclude each other", other.name)
+			}
+		}
+	}
+
+	r := &Runner{
+		cfg:     cfg,
+		metrics: NewMetrics(cfg),
+		logger:  logrus.New(),
+		logOut:  &swapWriter{w: io.Discard},
+		keyLog:  &swapWriter{w: io.Discard},
+	}
+
+	if cfg.VerifyAgainst != "" {
+		g, err := loadGolden(cfg.VerifyAgainst)
+		if err != nil {
+			return nil, fmt.Errorf("loading golden: %w", err)
+		}
+		r.golden = g
+	}
+	if cfg.BaselineFile != "" {
+		baseline, err := loadBaseline(cfg.BaselineFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading baseline: %w", err)
+		}
+		r.baseline = baseline
+	}
+
+	r.logger.SetLevel(logrus.DebugLevel)
+	r.logger.SetFormatter(&logrus.JSONFormatter{
+		PrettyPrint: cfg.JSONPretty,
+		FieldMap:    logFieldMap(cfg),
+	})
+	r.logger.SetOutput(r.logOut)
+	if cfg.LogFile != "" {
+		f, err := openLogFile(cfg.LogFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening log file: %w", err)
+		}
+		r.logOut.set(f)
+	}
+	if cfg.Syslog {
+		hook, err := newSyslogHook(cfg.SyslogNetwork, cfg.SyslogAddr)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to syslog: %w", err)
+		}
+		r.logger.AddHook(hook)
+	}
+
+	if cfg.HeadersFile != "" {
+		headers, err := readHeadersFile(cfg.HeadersFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading headers: %w", err)
+		}
+		r.headers = headers
+	}
+	r.headers = append(r.headers, cfg.Headers...)
+
+	if cfg.Sequence != "" {
+		steps, err := readSequence(cfg.Sequence)
+		if err != nil {
+			return nil, fmt.Errorf("reading sequence: %w", err)
+		}
+		for _, step := range steps {
+			if step.Body != "" && cfg.RawHeaderBytes > 0 {
+				return nil, errors.New("--raw-request-headers only supports steps without a body")
+			}
+		}
+		r.sequence = steps
+	}
+	// Before anything random, so that the body is reproduced too.
+	cfg.Seed = seedRandom(cfg.Seed)
+	if cfg.BodySize > 0 {
+		body, err := generateBody(cfg.BodySize, cfg.BodyFill)
+		if err != nil {
+			return nil, fmt.Errorf("generating body: %w", err)
+		}
+		r.body = body
+	}
+	if cfg.CookieJar {
+		r.jar, _ = cookiejar.New(nil)
+	}
+	if cfg.SessionCache || cfg.TLSEarlyData {
+		// 0-RTT resumes the session of an earlier connection.
+		r.sessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if cfg.WarmDNS {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+		defer cancel()
+		warm, err := newWarmDNS(ctx, targetURL)
+		if err != nil {
+			return nil, fmt.Errorf("warming DNS: %w", err)
+		}
+		r.warmDNS = warm
+	}
+
+	exporters := make(MultiExporter, 0, len(cfg.OutputFormats))
+	for _, format := range cfg.OutputFormats {
+		exporter, err := newExporter(format, cfg, r.logger, r.filePath)
+		if err != nil {
+			exporters.Close()
+			return nil, fmt.Errorf("creating %s exporter: %w", format, err)
+		}
+		exporters = append(exporters, exporter)
+	}
+	r.exporter = exporters
+
+	if cfg.ServeAddr != "" {
+		if err := serve(cfg.ServeAddr, r.metrics); err != nil {
+			return nil, fmt.Errorf("starting server: %w", err)
+		}
+	}
+	if cfg.PprofAddr != "" {
+		if err := servePprof(cfg.PprofAddr); err != nil {
+			return nil, fmt.Errorf("starting pprof server: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// swapWriter lets the long-lived logger and TLS config write to the files of
+// the current run.
+type swapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *swapWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// set switches to w once the writes in flight are done and returns the
+// previous writer.
+func (s *swapWriter) set(w io.Writer) io.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.w
+	s.w = w
+	return prev
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+// reopenLog points the logger to a newly opened --log-file, e.g. after
+// logrotate moved the old one away, and closes the old one.
+func (r *Runner) reopenLog() error {
+	f, err := openLogFile(r.cfg.LogFile)
+	if err != nil {
+		return err
+	}
+	if prev, ok := r.logOut.set(f).(io.Closer); ok {
+		prev.Close()
+	}
+	return nil
+}
+
+// newLogger points the logger to the log file of a single run. The returned
+// func closes the log file once the run is done.
+func (r *Runner) newLogger(runID string) (*logrus.Logger, func()) {
+	rawURL := targetURL
+	if len(r.sequence) > 0 {
+		rawURL = r.sequence[0].url()
+	}
+	r.files = newRunFiles(r.cfg.FileTemplate, runID, rawURL, time.Now())
+	if r.cfg.Syslog || r.cfg.LogFile != "" {
+		return r.logger, func() {}
+	}
+
+	path, err := r.files.path("-log.log")
+	if err != nil {
+		r.logger.Fatal(err)
+	}
+	logFile, err := os.Create(path)
+	if err != nil {
+		r.logger.Fatal(err)
+	}
+	r.logOut.set(logFile)
+
+	return r.logger, func() {
+		r.logOut.set(io.Discard)
+		logFile.Close()
+	}
+}
+
+// filePath returns the path of the file of the current run with suffix and
+// creates its directory.
+func (r *Runner) filePath(suffix string) (string, error) {
+	return r.files.path(suffix)
+}
+
+func (r *Runner) progress(a ...interface{}) {
+	if !r.cfg.Quiet {
+		fmt.Println(a...)
+	}
+}
+
+func (r *Runner) summary(a ...interface{}) {
+	if !r.cfg.NoSummary {
+		fmt.Println(a...)
+	}
+}
+
+// loop calls once until it reports a connection error or --count requests
+// are done, and returns the exit code. once returns nil when no request
+// could be made.
+func (r *Runner) loop(once func() *RequestResult) int {
+	// Once the loop gave up on a stuck request, what's stuck may hold up
+	// closing the capture and the exporters too: the program exits anyway
+	// after watchdogFlushTimeout.
+	var lastResort *time.Timer
+	defer func() {
+		if lastResort != nil {
+			lastResort.Stop()
+		}
+	}()
+	runCtx, abandon := context.WithCancelCause(context.Background())
+	defer abandon(nil)
+	ctx, stop := signal.NotifyContext(runCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer r.close()
+	r.ctx, r.abandon = ctx, abandon
+
+	if r.cfg.LogFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+				if err := r.reopenLog(); err != nil {
+					fmt.Fprintln(os.Stderr, "Error reopening log file:", err)
+				}
+			}
+		}()
+	}
+
+	// The count down replaces the progress lines on a terminal.
+	var cd *countDown
+	if r.cfg.Count > 0 && r.cfg.CountDown && !r.cfg.Quiet && isTerminal(os.Stdout) {
+		cd = &countDown{total: r.cfg.Count}
+	}
+	attempts := 0
+	finish := func(code int, a ...interface{}) int {
+		if cd != nil {
+			cd.done(attempts)
+		}
+		r.summary(a...)
+		if reused, total := r.metrics.connReuse(); total > 0 {
+			r.summary(fmt.Sprintf("connections reused: %d/%d (%.0f%%)", reused, total, 100*float64(reused)/float64(total)))
+		}
+		return code
+	}
+
+	start := time.Now()
+	if r.cfg.ReportInterval > 0 {
+		stopReports := r.startReports(start)
+		defer stopReports()
+	}
+	var backoff, retryAfter time.Duration
+	// unmade counts consecutive requests that couldn't be made.
+	unmade := 0
+	for i := 0; r.cfg.Count == 0 || i < r.cfg.Count; i++ {
+		// Without --interval the loop doesn't sleep, where it would see the
+		// signal.
+		if ctx.Err() != nil {
+			return finish(exitInterrupted, "interrupted")
+		}
+		wait := r.cfg.Interval
+		if backoff > 0 {
+			wait = backoff
+		}
+		wait = jitter(wait, r.cfg.IntervalJitter)
+		if retryAfter > 0 {
+			// Exactly as long as the server asked, not less with jitter.
+			wait = retryAfter
+		}
+		if i > 0 && wait > 0 {
+			slept, ok := sleep(ctx, wait)
+			r.slept = slept
+			if !ok {
+				return finish(exitInterrupted, "interrupted")
+			}
+		}
+
+		attempts = i + 1
+		if cd != nil {
+			cd.show(attempts)
+		} else {
+			r.progress("Trying HTTP request...")
+		}
+		// A request stuck for good is left behind, its goroutine with it, so
+		// the loop still closes the capture and the exporters on its way out.
+		results := make(chan *RequestResult, 1)
+		go func() { results <- once() }()
+		var result *RequestResult
+		select {
+		case result = <-results:
+		case <-runCtx.Done():
+			lastResort = time.AfterFunc(watchdogFlushTimeout, func() {
+				fmt.Fprintln(os.Stderr, "request stuck after the watchdog fired, exiting without flushing")
+				os.Exit(exitWatchdog)
+			})
+			if stopCapture := r.stopCapture.Load(); stopCapture != nil {
+				(*stopCapture)()
+			}
+			return finish(exitWatchdog, "request stuck after the watchdog canceled it, abandoned")
+		}
+		if cd != nil {
+			cd.record(result)
+		}
+		if ctx.Err() != nil {
+			// The request was canceled by the signal, not failed.
+			return finish(exitInterrupted, "interrupted")
+		}
+		backoff, retryAfter = 0, 0
+		if result == nil {
+			// Such as a client that can't be created: it's likely to fail
+			// again, so back off as for a retry rather than spin, even
+			// without --interval, and give up after --max-retries.
+			unmade++
+			if r.cfg.MaxRetries > 0 && unmade > r.cfg.MaxRetries {
+				return finish(exitUsage, "giving up after", unmade, "requests that couldn't be made")
+			}
+			backoff = retryBackoff(max(r.cfg.RetryBackoff, minUnmadeBackoff), unmade)
+			continue
+		}
+		unmade = 0
+		if r.cfg.RecordGolden != "" || r.golden != nil {
+			if diffs := r.checkGolden(result); len(diffs) > 0 {
+				r.summary(strings.Join(diffs, "\n"))
+				return finish(exitGoldenMismatch, "golden mismatch!!!", len(diffs), "differences from", r.cfg.VerifyAgainst)
+			}
+		}
+		if result.NotReused {
+			return finish(exitNotReused, "connection not reused!!!")
+		}
+		if result.Slow {
+			return finish(exitReproduced, "slow request found!!!", result.Durations["total"].Round(time.Millisecond), "over", r.cfg.StopOnSlow)
+		}
+		if r.cfg.AbortOnTLSError && result.TLSError != "" {
+			return finish(exitTLSError, "TLS handshake error found!!!", result.TLSError)
+		}
+		if r.cfg.UntilSuccess {
+			if r.succeeded(result) {
+				return finish(exitCountExhausted, "succeeded after", attempts, "requests in", time.Since(start).Round(time.Millisecond))
+			}
+		} else if r.cfg.StopWhen.alternatives != nil {
+			if r.cfg.StopWhen.match(result) {
+				return finish(exitReproduced, "stop condition met:", r.cfg.StopWhen.String())
+			}
+		} else if len(r.cfg.ExpectErrors) > 0 {
+			if !r.succeeded(result) {
+				return finish(exitReproduced, "unexpected outcome, expected", r.cfg.ExpectErrors.String(), "error but got", describeOutcome(result))
+			}
+		} else if result.Error != "" {
+			return finish(exitReproduced, "connection error found!!!")
+		}
+		if result.Retry != nil {
+			if r.cfg.MaxRetries > 0 && result.Retry.Attempt > r.cfg.MaxRetries {
+				return finish(exitRetriesGaveUp, "giving up after", r.cfg.MaxRetries, "retries, last status", result.Status)
+			}
+			backoff = result.Retry.Backoff
+		}
+		retryAfter = result.RetryAfter
+	}
+
+	if r.cfg.UntilSuccess {
+		return finish(exitNoSuccess, "no request succeeded in", r.cfg.Count, "requests")
+	}
+	if len(r.cfg.SLOs) > 0 && !r.checkSLOs() {
+		return finish(exitSLOFailed, "SLO missed in", r.cfg.Count, "requests")
+	}
+	if len(r.cfg.ExpectErrors) > 0 {
+		return finish(exitCountExhausted, "only expected errors in", r.cfg.Count, "requests")
+	}
+	return finish(exitCountExhausted, "no connection error found in", r.cfg.Count, "requests")
+}
+
+// succeeded reports whether result is a success: a response below 400 that
+// isn't retried or, with --expect-error, an error of the listed categories
+// instead.
+func (r *Runner) succeeded(result *RequestResult) bool {
+	if len(r.cfg.ExpectErrors) > 0 {
+		return result.Error != "" && slices.Contains(r.cfg.ExpectErrors, result.ErrorCategory)
+	}
+	return result.Error == "" && result.Status < 400 && result.Retry == nil
+}
+
+// describeOutcome is the outcome of result for the final message.
+func describeOutcome(result *RequestResult) string {
+	if result.Error != "" {
+		return result.ErrorCategory + " error"
+	}
+	if result.Status == 0 {
+		// --tcp-only.
+		return "connected"
+	}
+	return fmt.Sprint("status ", result.Status)
+}
+
+// jitter randomizes d by up to +/- percent percent.
+func jitter(d time.Duration, percent float64) time.Duration {
+	if percent <= 0 {
+		return d
+	}
+	factor := 1 + percent/100*(2*random.Float64()-1)
+	return time.Duration(float64(d) * factor)
+}
+
+// sleep waits for d unless ctx is done first. It returns how long it actually
+// slept and whether it slept the full duration.
+func sleep(ctx context.Context, d time.Duration) (time.Duration, bool) {
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return time.Since(start), true
+	case <-ctx.Done():
+		return time.Since(start), false
+	}
+}
+
+func (r *Runner) close() {
+	if r.client != nil {
+		if c, ok := r.client.Transport.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	if err := r.exporter.Close(); err != nil {
+		fmt.Println("Error closing exporter:", err)
+	}
+	if f, ok := r.logOut.set(io.Discard).(io.Closer); ok {
+		f.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// closeExporter counts the results exported and whether it was closed.
+type closeExporter struct {
+	exported atomic.Int32
+	closed   atomic.Bool
+}
+
+func (e *closeExporter) Export(string, *RequestResult) error {
+	e.exported.Add(1)
+	return nil
+}
+
+func (e *closeExporter) Close() error {
+	e.closed.Store(true)
+	return nil
+}
+
+// newTestRunner returns a runner of cfg with just what loop needs, quiet.
+func newTestRunner(cfg *Config) (*Runner, *closeExporter) {
+	cfg.Quiet, cfg.NoSummary = true, true
+	exporter := &closeExporter{}
+	return &Runner{
+		cfg:      cfg,
+		metrics:  NewMetrics(cfg),
+		logger:   logrus.New(),
+		logOut:   &swapWriter{w: io.Discard},
+		exporter: exporter,
+	}, exporter
+}
+
+// TestLoopAbandonsStuckRequest runs a request that ignores the cancellation
+// of the watchdog: the loop gives up on it, stops its capture and closes
+// the exporters before returning the watchdog exit code.
+func TestLoopAbandonsStuckRequest(t *testing.T) {
+	r, exporter := newTestRunner(&Config{WatchdogTimeout: 20 * time.Millisecond})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	release := make(chan struct{})
+	defer close(release)
+	var captureStopped atomic.Bool
+	once := func() *RequestResult {
+		stopCapture := func() { captureStopped.Store(true) }
+		r.stopCapture.Store(&stopCapture)
+		trace := NewBufferedClientTrace(nil)
+		_, stop := r.traceContext(logger, trace)
+		defer stop()
+		<-release
+		return nil
+	}
+
+	codes := make(chan int, 1)
+	go func() { codes <- r.loop(once) }()
+	select {
+	case code := <-codes:
+		if code != exitWatchdog {
+			t.Errorf("exit code %d, want %d", code, exitWatchdog)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop still waiting for the stuck request")
+	}
+	if !captureStopped.Load() {
+		t.Error("capture of the stuck request not stopped")
+	}
+	if !exporter.closed.Load() {
+		t.Error("exporter not closed")
+	}
+}
+
+// TestLoopBacksOffUnmadeRequests runs a loop without --count whose requests
+// can't be made: it waits between them and gives up after --max-retries.
+func TestLoopBacksOffUnmadeRequests(t *testing.T) {
+	r, _ := newTestRunner(&Config{MaxRetries: 2})
+	calls := 0
+	start := time.Now()
+	code := r.loop(func() *RequestResult {
+		calls++
+		return nil
+	})
+	if code != exitUsage {
+		t.Errorf("exit code %d, want %d", code, exitUsage)
+	}
+	if calls != 3 {
+		t.Errorf("%d requests, want 3", calls)
+	}
+	if elapsed, want := time.Since(start), minUnmadeBackoff+2*minUnmadeBackoff; elapsed < want {
+		t.Errorf("loop took %s, want at least %s of backoff", elapsed, want)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// schemaVersion is the version of the result records, the entries with
+// stages of the run log and the objects of the ndjson, kafka and
+// elasticsearch formats. Bump it when a field of resultSchema changes type or
+// meaning or is removed; new optional fields don't need it.
+const schemaVersion = 1
+
+type fieldSchema struct {
+	kind     string // the JSON type: string, number, bool, object or array
+	required bool
+}
+
+// resultSchema are the fields of a result record, those of both kinds of
+// records unless logOnly or recordOnly.
+var resultSchema = map[string]struct {
+	fieldSchema
+	logOnly, recordOnly bool
+}{
+	"schemaVersion": {fieldSchema: fieldSchema{"number", true}},
+	"runID":         {fieldSchema: fieldSchema{"string", true}},
+	"stages":        {fieldSchema: fieldSchema{"array", true}},
+	"attempts":      {fieldSchema: fieldSchema{"array", false}},
+	"status":        {fieldSchema: fieldSchema{"number", false}},
+	"error":         {fieldSchema: fieldSchema{"string", false}},
+	"errorCategory": {fieldSchema: fieldSchema{"string", false}},
+	"remoteAddr":    {fieldSchema: fieldSchema{"string", false}},
+	"sessionID":     {fieldSchema: fieldSchema{"string", false}},
+	"step":          {fieldSchema: fieldSchema{"number", false}},
+	"level":         {fieldSchema: fieldSchema{"string", true}, logOnly: true},
+	"msg":           {fieldSchema: fieldSchema{"string", true}, logOnly: true},
+	"time":          {fieldSchema: fieldSchema{"string", true}, logOnly: true},
+	"method":        {fieldSchema: fieldSchema{"string", true}, recordOnly: true},
+	"url":           {fieldSchema: fieldSchema{"string", true}, recordOnly: true},
+	"start":         {fieldSchema: fieldSchema{"string", true}, recordOnly: true},
+	"proto":         {fieldSchema: fieldSchema{"string", true}, recordOnly: true},
+	"durationsMs":   {fieldSchema: fieldSchema{"object", true}, recordOnly: true},
+}
+
+// stageSchema are the fields of every stage.
+var stageSchema = map[string]fieldSchema{
+	"Name":         {"string", true},
+	"Time":         {"string", true},
+	"RelativeTime": {"number", false},
+	"Values":       {"object", false},
+	"Original":     {"string", false},
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "bool"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "null"
+}
+
+func checkField(obj map[string]interface{}, name string, field fieldSchema) error {
+	v, ok := obj[name]
+	if !ok || v == nil {
+		if field.required {
+			return fmt.Errorf("missing %s", name)
+		}
+		return nil
+	}
+	if kind := jsonKind(v); kind != field.kind {
+		return fmt.Errorf("%s is a %s, want a %s", name, kind, field.kind)
+	}
+	return nil
+}
+
+// logFieldMap is the FieldMap of the JSON log entries, their level, msg and
+// time renamed by --json-log-*-field-name.
+func logFieldMap(cfg *Config) logrus.FieldMap {
+	return logrus.FieldMap{
+		logrus.FieldKeyLevel: cfg.LogLevelKey,
+		logrus.FieldKeyMsg:   cfg.LogMsgKey,
+		logrus.FieldKeyTime:  cfg.LogTimeKey,
+	}
+}
+
+// canonicalEntry returns a log entry written with fieldMap under the default
+// names: the renamed level, msg and time back under theirs, and the fields
+// logrus moved to fields.NAME as they clashed with one of them back under
+// NAME. Objects without the renamed msg, the records of the other formats,
+// are returned as is.
+func canonicalEntry[V any](obj map[string]V, fieldMap logrus.FieldMap) map[string]V {
+	if _, ok := obj[fieldMap[logrus.FieldKeyMsg]]; !ok {
+		return obj
+	}
+
+	defaults := make(map[string]string, len(fieldMap))
+	for name, key := range fieldMap {
+		defaults[key] = string(name)
+	}
+	entry := make(map[string]V, len(obj))
+	for key, v := range obj {
+		if _, ok := defaults[key]; ok {
+			continue
+		}
+		if name, ok := strings.CutPrefix(key, "fields."); ok {
+			if _, clash := defaults[name]; clash {
+				key = name
+			}
+		}
+		entry[key] = v
+	}
+	for key, name := range defaults {
+		if v, ok := obj[key]; ok {
+			entry[name] = v
+		}
+	}
+	return entry
+}
+
+// validateRecord checks a result record against the schema. Log entries are
+// told from records by their msg, so obj has the default names of
+// canonicalEntry.
+func validateRecord(obj map[string]interface{}) []error {
+	var errs []error
+	if v, ok := obj["schemaVersion"].(json.Number); ok && v.String() != fmt.Sprint(schemaVersion) {
+		return []error{fmt.Errorf("schema version %v, this validator knows %d", v, schemaVersion)}
+	}
+
+	_, isLog := obj["msg"]
+	names := make([]string, 0, len(resultSchema))
+	for name := range resultSchema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := resultSchema[name]
+		if (isLog && field.recordOnly) || (!isLog && field.logOnly) {
+			continue
+		}
+		if err := checkField(obj, name, field.fieldSchema); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	stages, _ := obj["stages"].([]interface{})
+	for i, s := range stages {
+		stage, ok := s.(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("stage %d is a %s, want an object", i, jsonKind(s)))
+			continue
+		}
+		for name, field := range stageSchema {
+			if err := checkField(stage, name, field); err != nil {
+				errs = append(errs, fmt.Errorf("stage %d: %w", i, err))
+			}
+		}
+		if t, ok := stage["Time"].(string); ok {
+			if _, err := time.Parse(time.RFC3339Nano, t); err != nil {
+				errs = append(errs, fmt.Errorf("stage %d: Time: %w", i, err))
+			}
+		}
+	}
+	return errs
+}
+
+// lineCounter counts the lines of what's read through it, to tell the
+// line of an offset of the json.Decoder reading from it.
+type lineCounter struct {
+	r io.Reader
+	// read is the offset of the next byte, newlines those of the lines
+	// not yet reached by line, passed counts those reached.
+	read     int64
+	newlines []int64
+	passed   int
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			c.newlines = append(c.newlines, c.read+int64(i))
+		}
+	}
+	c.read += int64(n)
+	return n, err
+}
+
+// line returns the line of offset, not before that of the previous call.
+func (c *lineCounter) line(offset int64) int {
+	i := sort.Search(len(c.newlines), func(i int) bool { return c.newlines[i] >= offset })
+	c.passed += i
+	c.newlines = c.newlines[i:]
+	return c.passed + 1
+}
+
+// decodeEntries calls f with every JSON value of r, one per line or
+// indented by --json-pretty alike, and the line it starts on. A value cut
+// at the end, such as the last entry of a log still being written, ends r.
+func decodeEntries(r io.Reader, f func(line int, raw json.RawMessage)) error {
+	lines := &lineCounter{r: r}
+	dec := json.NewDecoder(lines)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lines.line(dec.InputOffset()), err)
+		}
+		f(lines.line(dec.InputOffset()-int64(len(raw))), raw)
+	}
+}
+
+// validateFile checks the result records of a run log or ndjson file, the
+// entries with stages, and reports every mismatch to w. It returns how many
+// records it checked and how many were invalid.
+func validateFile(w io.Writer, path string, fieldMap logrus.FieldMap) (records, invalid int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	err = decodeEntries(f, func(line int, raw json.RawMessage) {
+		// Numbers are kept as is, stage values can hold ones beyond float64
+		// such as the modulus of a certificate.
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return
+		}
+		obj = canonicalEntry(obj, fieldMap)
+		if _, ok := obj["stages"]; !ok {
+			return
+		}
+		records++
+		if errs := validateRecord(obj); len(errs) > 0 {
+			invalid++
+			for _, err := range errs {
+				fmt.Fprintf(w, "%s:%d: %v\n", path, line, err)
+			}
+		}
+	})
+	if err != nil {
+		return records, invalid, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, invalid, nil
+}
+
+func validateMain(args []string) int {
+	var cfg Config
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	logFieldFlags(fs, &cfg)
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Println("Usage: go run . validate [--json-log-*-field-name NAME]... <run.log|results.ndjson>...")
+		return exitUsage
+	}
+
+	code := 0
+	for _, path := range fs.Args() {
+		records, invalid, err := validateFile(os.Stdout, path, logFieldMap(&cfg))
+		if err != nil {
+			fmt.Println(err)
+			return exitUsage
+		}
+		fmt.Printf("%s: %d of %d records valid (schema version %d)\n", path, records-invalid, records, schemaVersion)
+		if invalid > 0 || records == 0 {
+			code = 1
+		}
+	}
+	return code
+}
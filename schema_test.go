@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestValidateRenamedLogFields writes run logs with renamed level, msg and
+// time fields and reads them back with validate and compare.
+func TestValidateRenamedLogFields(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"defaults", Config{LogLevelKey: "level", LogMsgKey: "msg", LogTimeKey: "time"}},
+		{"renamed", Config{LogLevelKey: "severity", LogMsgKey: "message", LogTimeKey: "@timestamp"}},
+		// The error of the result clashes with the msg, logrus keeps it as
+		// fields.error.
+		{"clash", Config{LogLevelKey: "status", LogMsgKey: "error", LogTimeKey: "time"}},
+	}
+
+	start := time.Now()
+	result := &RequestResult{
+		Status: 200,
+		Error:  "connection refused",
+		Stages: []Stage{
+			{Name: "Request", Time: start, Values: map[string]interface{}{"url": "https://example.com/"}},
+			{Name: "ConnectDone", Time: start.Add(3 * time.Millisecond), Values: map[string]interface{}{"error": nil}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&buf)
+			logger.SetFormatter(&logrus.JSONFormatter{FieldMap: logFieldMap(&test.cfg)})
+			if err := (&JSONExporter{logger: logger}).Export("run", result); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "run.log")
+			if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			var report bytes.Buffer
+			records, invalid, err := validateFile(&report, path, logFieldMap(&test.cfg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if records != 1 || invalid != 0 {
+				t.Errorf("validateFile = %d records, %d invalid, want 1 valid:\n%s", records, invalid, report.String())
+			}
+
+			run, err := loadRun(path, logFieldMap(&test.cfg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.Error != result.Error || len(run.Stages) != len(result.Stages) {
+				t.Errorf("loadRun = error %q with %d stages, want %q with %d", run.Error, len(run.Stages), result.Error, len(result.Stages))
+			}
+		})
+	}
+}
+
+// TestValidateRenamedLogFieldsWithDefaults checks that a log with renamed
+// fields is invalid when read with the default names.
+func TestValidateRenamedLogFieldsWithDefaults(t *testing.T) {
+	renamed := Config{LogLevelKey: "severity", LogMsgKey: "message", LogTimeKey: "@timestamp"}
+	defaults := Config{LogLevelKey: "level", LogMsgKey: "msg", LogTimeKey: "time"}
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{FieldMap: logFieldMap(&renamed)})
+	result := &RequestResult{Status: 200, Stages: []Stage{{Name: "Request", Time: time.Now()}}}
+	if err := (&JSONExporter{logger: logger}).Export("run", result); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "run.log")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var report bytes.Buffer
+	records, invalid, err := validateFile(&report, path, logFieldMap(&defaults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 1 || invalid != 1 {
+		t.Errorf("validateFile = %d records, %d invalid, want 1 invalid", records, invalid)
+	}
+}
+
+// TestValidatePrettyLog reads a log written with --json-pretty, reporting a
+// mismatch at the line its entry starts on.
+func TestValidatePrettyLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{PrettyPrint: true})
+	result := &RequestResult{Status: 200, Stages: []Stage{{Name: "Request", Time: time.Now()}}}
+	if err := (&JSONExporter{logger: logger}).Export("run", result); err != nil {
+		t.Fatal(err)
+	}
+	line := bytes.Count(buf.Bytes(), []byte("\n")) + 1
+	logger.WithField("stages", "none").Info("Not a result")
+	// Cut in the middle of its last entry, as a log still being written.
+	if err := (&JSONExporter{logger: logger}).Export("run", result); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "run.log")
+	if err := os.WriteFile(path, buf.Bytes()[:buf.Len()-20], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fieldMap := logFieldMap(&Config{LogLevelKey: "level", LogMsgKey: "msg", LogTimeKey: "time"})
+	var report bytes.Buffer
+	records, invalid, err := validateFile(&report, path, fieldMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 2 || invalid != 1 {
+		t.Errorf("validateFile = %d records, %d invalid, want 2 with 1 invalid:\n%s", records, invalid, report.String())
+	}
+	if want := fmt.Sprintf("%s:%d: stages is a string, want a array\n", path, line); !strings.Contains(report.String(), want) {
+		t.Errorf("report:\n%s\nwant the line %q", report.String(), want)
+	}
+
+	run, err := loadRun(path, fieldMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != 200 || len(run.Stages) != 1 {
+		t.Errorf("loadRun = status %d with %d stages, want the first entry", run.Status, len(run.Stages))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// random is the source of everything random the tool does: the jitter of
+// the intervals, the random bodies and the trace, span and session IDs. It's
+// seeded with --seed, so that a run can be reproduced.
+var random = newLockedRand(time.Now().UnixNano())
+
+// lockedRand is a rand.Rand safe for the goroutines of the exporters.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+// Read fills b with random bytes.
+func (l *lockedRand) Read(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var chunk [8]byte
+	for len(b) > 0 {
+		binary.LittleEndian.PutUint64(chunk[:], l.r.Uint64())
+		b = b[copy(b, chunk[:]):]
+	}
+}
+
+// seedRandom seeds random with seed, a time-based one when it's 0, and
+// returns the seed used.
+func seedRandom(seed int64) int64 {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	random = newLockedRand(seed)
+	return seed
+}
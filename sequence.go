@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// requestStep is a request of a --sequence. The zero step is the GET of the
+// target URL the loop does by default.
+type requestStep struct {
+	Name    string   `json:"name"`
+	Method  string   `json:"method"`
+	URL     string   `json:"url"`
+	Headers []string `json:"headers"`
+	Body    string   `json:"body"`
+}
+
+func (s requestStep) method() string {
+	if s.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(s.Method)
+}
+
+func (s requestStep) url() string {
+	if s.URL == "" {
+		return targetURL
+	}
+	return s.URL
+}
+
+func (s requestStep) body() io.Reader {
+	if s.Body == "" {
+		return nil
+	}
+	return strings.NewReader(s.Body)
+}
+
+// readSequence reads the JSON array of steps of a --sequence file.
+func readSequence(path string) ([]requestStep, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var steps []requestStep
+	if err := json.Unmarshal(b, &steps); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	for i, step := range steps {
+		u, err := url.Parse(step.URL)
+		if err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("%s: step %d: invalid url %q", path, i+1, step.URL)
+		}
+		for _, line := range step.Headers {
+			if _, _, ok := splitHeaderLine(line); !ok {
+				return nil, fmt.Errorf("%s: step %d: invalid header %q", path, i+1, line)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// newSessionID returns the random ID grouping the steps of one run of a
+// sequence.
+func newSessionID() string {
+	b := make([]byte, 8)
+	random.Read(b)
+	return hex.EncodeToString(b)
+}
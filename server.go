@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+func serve(addr string, metrics *Metrics) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writePrometheus(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	// Ready while most of the requests of the ready window succeeded, so a
+	// single failure doesn't flap it.
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		succeeded, total := metrics.readiness()
+		if total == 0 || 2*succeeded <= total {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintf(w, "%d/%d requests succeeded in the last %s\n", succeeded, total, metrics.readyWindow)
+	})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		_ = http.Serve(listener, mux)
+	}()
+
+	return nil
+}
+
+// servePprof serves the profiles of the tool itself, apart from the metrics
+// so they aren't exposed along with them.
+func servePprof(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		_ = http.Serve(listener, mux)
+	}()
+
+	return nil
+}
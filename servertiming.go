@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// splitQuoted splits s at sep outside of quoted strings, where a backslash
+// escapes the next character.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns the value of a token or of a quoted string, false when it's
+// neither.
+func unquote(s string) (string, bool) {
+	if !strings.HasPrefix(s, `"`) {
+		return s, s != "" && !strings.ContainsAny(s, `"\ `)
+	}
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), true
+}
+
+// parseServerTiming returns the metrics of the Server-Timing header values,
+// e.g. `db;dur=53, cache;desc="Cache Read";dur=23.2`: each has its name,
+// its duration in milliseconds (`durMs`) and description when given, and any
+// other parameter as is, empty when it has no value, e.g. `cache;miss`. A
+// metric without a name or whose duration isn't a number is in malformed as
+// received rather than failing the others.
+func parseServerTiming(values []string) (metrics []map[string]interface{}, malformed []string) {
+	for _, value := range values {
+		for _, entry := range splitQuoted(value, ',') {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if metric, ok := parseServerTimingMetric(entry); ok {
+				metrics = append(metrics, metric)
+			} else {
+				malformed = append(malformed, entry)
+			}
+		}
+	}
+	return metrics, malformed
+}
+
+func parseServerTimingMetric(entry string) (map[string]interface{}, bool) {
+	params := splitQuoted(entry, ';')
+	name := strings.TrimSpace(params[0])
+	if name == "" || strings.ContainsAny(name, `"=\ `) {
+		return nil, false
+	}
+	metric := map[string]interface{}{"name": name}
+	seen := map[string]bool{}
+	for _, param := range params[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, ok := unquote(value); ok {
+			value = unquoted
+		}
+		// The first of a repeated parameter wins, as the spec says.
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		switch key {
+		case "dur":
+			ms, err := strconv.ParseFloat(value, 64)
+			if err != nil || ms < 0 {
+				return nil, false
+			}
+			metric["durMs"] = ms
+		case "name", "durms":
+			// Not to overwrite the name or the duration.
+			metric["param."+key] = value
+		default:
+			metric[key] = value
+		}
+	}
+	return metric, true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServerTiming(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    []string
+		metrics   []map[string]interface{}
+		malformed []string
+	}{
+		{
+			name:   "duration and description",
+			values: []string{`db;dur=53, cache;desc="Cache Read";dur=23.2`},
+			metrics: []map[string]interface{}{
+				{"name": "db", "durMs": 53.0},
+				{"name": "cache", "desc": "Cache Read", "durMs": 23.2},
+			},
+		},
+		{
+			name:   "parameter without a value",
+			values: []string{`cache;miss;dur=1.5`, `edge;hit`},
+			metrics: []map[string]interface{}{
+				{"name": "cache", "miss": "", "durMs": 1.5},
+				{"name": "edge", "hit": ""},
+			},
+		},
+		{
+			name:   "quoted separators",
+			values: []string{`app;desc="a, b; c=\"d\""`},
+			metrics: []map[string]interface{}{
+				{"name": "app", "desc": `a, b; c="d"`},
+			},
+		},
+		{
+			name:   "first repeated parameter wins",
+			values: []string{`db;dur=1;dur=2;DESC=x;desc=y`},
+			metrics: []map[string]interface{}{
+				{"name": "db", "durMs": 1.0, "desc": "x"},
+			},
+		},
+		{
+			name:   "duration that isn't a number",
+			values: []string{`db;dur=fast, cache;dur, total;dur=-1, ok;dur=2`},
+			metrics: []map[string]interface{}{
+				{"name": "ok", "durMs": 2.0},
+			},
+			malformed: []string{"db;dur=fast", "cache;dur", "total;dur=-1"},
+		},
+		{
+			name:      "without a name",
+			values:    []string{`;dur=1, "db";dur=2, , miss`},
+			metrics:   []map[string]interface{}{{"name": "miss"}},
+			malformed: []string{";dur=1", `"db";dur=2`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, malformed := parseServerTiming(tt.values)
+			if !reflect.DeepEqual(metrics, tt.metrics) {
+				t.Errorf("metrics = %v, want %v", metrics, tt.metrics)
+			}
+			if !reflect.DeepEqual(malformed, tt.malformed) {
+				t.Errorf("malformed = %q, want %q", malformed, tt.malformed)
+			}
+		})
+	}
+}
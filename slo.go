@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// sloTarget is a percentile of a phase that has to stay within threshold.
+type sloTarget struct {
+	phase      string
+	percentile float64
+	threshold  time.Duration
+}
+
+func (t sloTarget) name() string {
+	return t.phase + ".p" + strconv.FormatFloat(t.percentile, 'f', -1, 64)
+}
+
+// sloTargets are the targets of --slo, given as phase.pNN=duration pairs.
+type sloTargets []sloTarget
+
+func (s *sloTargets) String() string {
+	pairs := make([]string, 0, len(*s))
+	for _, t := range *s {
+		pairs = append(pairs, t.name()+"="+t.threshold.String())
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (s *sloTargets) Set(value string) error {
+	names := append(phaseNames(), "total")
+	var targets sloTargets
+	for _, pair := range strings.Split(value, ",") {
+		key, d, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		phase, p, ok2 := strings.Cut(key, ".p")
+		if !ok || !ok2 || !slices.Contains(names, phase) {
+			return fmt.Errorf("invalid SLO %q, want phase.pNN=duration with phase one of %s", pair, strings.Join(names, ", "))
+		}
+		percentile, err := strconv.ParseFloat(p, 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return fmt.Errorf("invalid percentile of %s: %q", phase, p)
+		}
+		threshold, err := time.ParseDuration(d)
+		if err != nil || threshold <= 0 {
+			return fmt.Errorf("invalid threshold of %s: %q", key, d)
+		}
+		targets = append(targets, sloTarget{phase: phase, percentile: percentile, threshold: threshold})
+	}
+	*s = targets
+	return nil
+}
+
+// percentile returns the nearest-rank percentile p of sorted, which must not
+// be empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// checkSLOs prints a table of the --slo targets next to the percentiles
+// measured over the run and reports whether every one was met. A phase no
+// request went through fails its targets.
+func (r *Runner) checkSLOs() bool {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SLO\tthreshold\tmeasured\tsamples\tresult")
+
+	met := true
+	for _, target := range r.cfg.SLOs {
+		samples := r.metrics.phaseSamples(target.phase)
+		measured, result := "n/a", "FAIL"
+		if len(samples) > 0 {
+			d := percentile(samples, target.percentile)
+			measured = d.Round(time.Microsecond).String()
+			if d <= target.threshold {
+				result = "pass"
+			}
+		}
+		if result != "pass" {
+			met = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", target.name(), target.threshold, measured, len(samples), result)
+	}
+	w.Flush()
+
+	r.summary(strings.TrimSuffix(b.String(), "\n"))
+	return met
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stageNames renames stages in the results exported, from the name of the
+// httptrace callback or added stage to that of --stage-names.
+type stageNames map[string]string
+
+func (n *stageNames) String() string {
+	pairs := make([]string, 0, len(*n))
+	for from, to := range *n {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (n *stageNames) Set(value string) error {
+	names := stageNames{}
+	renamed := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid stage name %q, want Stage=name, e.g. DNSDone=dns_lookup", pair)
+		}
+		if other, ok := renamed[to]; ok && other != from {
+			return fmt.Errorf("%s and %s both renamed to %q", other, from, to)
+		}
+		names[from] = to
+		renamed[to] = from
+	}
+	*n = names
+	return nil
+}
+
+// rename returns stages with the names of n. The stages keep their own names
+// as Original for findStage, so the phases and spans of the exporters, and
+// of compare reading them back, are the same.
+func (n stageNames) rename(stages []Stage) []Stage {
+	renamed := make([]Stage, len(stages))
+	for i, stage := range stages {
+		if to, ok := n[stage.Name]; ok {
+			stage.Original = stage.Name
+			stage.Name = to
+		}
+		renamed[i] = stage
+	}
+	return renamed
+}
+
+// renameResult returns a copy of result and its attempts with the stage names
+// of n, result itself being left as is for the rest of the run.
+func (n stageNames) renameResult(result *RequestResult) *RequestResult {
+	renamed := *result
+	renamed.Stages = n.rename(result.Stages)
+	if len(result.Attempts) > 0 {
+		renamed.Attempts = make([]*RequestResult, len(result.Attempts))
+		for i, attempt := range result.Attempts {
+			renamed.Attempts[i] = n.renameResult(attempt)
+		}
+	}
+	return &renamed
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type fieldKind int
+
+const (
+	kindNumber fieldKind = iota
+	kindString
+	kindDuration
+)
+
+// stopFields are the fields of a result --stop-when can test, besides the
+// phase durations.
+var stopFields = map[string]fieldKind{
+	"status":         kindNumber,
+	"proto":          kindString,
+	"error":          kindString,
+	"error.category": kindString,
+	"tls_error":      kindString,
+}
+
+func stopFieldKind(field string) (fieldKind, bool) {
+	if kind, ok := stopFields[field]; ok {
+		return kind, true
+	}
+	if field == "total" || slices.Contains(phaseNames(), field) {
+		return kindDuration, true
+	}
+	return 0, false
+}
+
+// comparison is a single `field op value` test of a stop condition.
+type comparison struct {
+	field string
+	op    string
+	value string
+
+	number   float64
+	duration time.Duration
+}
+
+func (c *comparison) match(result *RequestResult) bool {
+	kind, _ := stopFieldKind(c.field)
+	switch kind {
+	case kindNumber:
+		return compare(float64(result.Status), c.number, c.op)
+	case kindDuration:
+		d, ok := result.Durations[c.field]
+		return ok && compare(d, c.duration, c.op)
+	}
+
+	var s string
+	switch c.field {
+	case "proto":
+		s = result.Proto
+	case "error":
+		s = result.Error
+	case "error.category":
+		s = result.ErrorCategory
+	case "tls_error":
+		s = result.TLSError
+	}
+	return (s == c.value) == (c.op == "==")
+}
+
+func compare[T float64 | time.Duration](a, b T, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+// stopCondition is the --stop-when expression: comparisons joined by && and
+// ||, where && binds tighter. It is held as a list of alternatives of which
+// all comparisons must match.
+type stopCondition struct {
+	expr         string
+	alternatives [][]*comparison
+}
+
+func (c *stopCondition) String() string {
+	return c.expr
+}
+
+func (c *stopCondition) Set(value string) error {
+	tokens, err := tokenizeStopCondition(value)
+	if err != nil {
+		return err
+	}
+
+	var alternatives [][]*comparison
+	var all []*comparison
+	for i := 0; ; {
+		if len(tokens)-i < 3 {
+			return fmt.Errorf("incomplete comparison at the end of %q", value)
+		}
+		cmp, err := parseComparison(tokens[i], tokens[i+1], tokens[i+2])
+		if err != nil {
+			return err
+		}
+		all = append(all, cmp)
+		i += 3
+
+		if i == len(tokens) {
+			alternatives = append(alternatives, all)
+			break
+		}
+		switch strings.ToLower(tokens[i]) {
+		case "&&", "and":
+		case "||", "or":
+			alternatives = append(alternatives, all)
+			all = nil
+		default:
+			return fmt.Errorf("expected && or || instead of %q", tokens[i])
+		}
+		i++
+	}
+
+	*c = stopCondition{expr: value, alternatives: alternatives}
+	return nil
+}
+
+func (c *stopCondition) match(result *RequestResult) bool {
+	for _, all := range c.alternatives {
+		matched := true
+		for _, cmp := range all {
+			if !cmp.match(result) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func parseComparison(field, op, value string) (*comparison, error) {
+	kind, ok := stopFieldKind(field)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", field)
+	}
+	if !slices.Contains([]string{"==", "!=", ">", ">=", "<", "<="}, op) {
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+
+	cmp := &comparison{field: field, op: op, value: value}
+	var err error
+	switch kind {
+	case kindString:
+		if op != "==" && op != "!=" {
+			return nil, fmt.Errorf("%s can only be compared with == or !=", field)
+		}
+		if field == "error.category" && !slices.Contains(errorCategories, value) {
+			return nil, fmt.Errorf("unknown error category %q, must be one of %s", value, strings.Join(errorCategories, ", "))
+		}
+	case kindNumber:
+		cmp.number, err = strconv.ParseFloat(value, 64)
+	case kindDuration:
+		cmp.duration, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %w", field, err)
+	}
+	return cmp, nil
+}
+
+// tokenizeStopCondition splits an expression into fields, operators and
+// values. Values can be double-quoted.
+func tokenizeStopCondition(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			value, err := strconv.QuotedPrefix(s[i:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated string in %q", s)
+			}
+			unquoted, _ := strconv.Unquote(value)
+			tokens = append(tokens, unquoted)
+			i += len(value)
+		case strings.ContainsRune("=!<>&|", c):
+			j := i + 1
+			for j < len(s) && strings.ContainsRune("=!<>&|", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			j := i + 1
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("=!<>&|\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty stop condition")
+	}
+	return tokens, nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	logrussyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// newSyslogHook dials syslog up front so an unreachable daemon is reported
+// before the loop starts. An empty network means the local syslog.
+func newSyslogHook(network, addr string) (logrus.Hook, error) {
+	return logrussyslog.NewSyslogHook(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "dump-pcap")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// leafCertificate returns the certificate presented by the server, also when
+// the handshake failed on its verification.
+func leafCertificate(state tls.ConnectionState, err error) *x509.Certificate {
+	if len(state.PeerCertificates) > 0 {
+		return state.PeerCertificates[0]
+	}
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) && len(verifyErr.UnverifiedCertificates) > 0 {
+		return verifyErr.UnverifiedCertificates[0]
+	}
+	return nil
+}
+
+// serverNameValues records the SNI that was sent and the names of the
+// presented certificate, flagging when they don't match.
+func serverNameValues(state tls.ConnectionState, err error) map[string]interface{} {
+	values := map[string]interface{}{
+		"sni": state.ServerName,
+	}
+	leaf := leafCertificate(state, err)
+	if leaf == nil {
+		return values
+	}
+
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	values["certNames"] = names
+	values["sniMismatch"] = state.ServerName != "" && leaf.VerifyHostname(state.ServerName) != nil
+
+	return values
+}
+
+// tlsError returns the error of the failed TLS handshake of stages, if any,
+// prefixed with "proxy: " when it's the one with an HTTPS proxy.
+func tlsError(stages []Stage) string {
+	for _, stage := range stages {
+		msg, ok := stage.Values["tlsError"].(string)
+		switch {
+		case !ok:
+		case stage.Name == "TLSHandshakeDone":
+			return msg
+		case stage.Name == "ProxyTLSHandshakeDone":
+			return "proxy: " + msg
+		}
+	}
+	return ""
+}
+
+var renegotiationSupport = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// renegotiation is the TLS renegotiation the client accepts: never, once or
+// freely.
+type renegotiation string
+
+func (r *renegotiation) String() string {
+	return string(*r)
+}
+
+func (r *renegotiation) Set(value string) error {
+	if _, ok := renegotiationSupport[value]; !ok {
+		return fmt.Errorf("invalid renegotiation %q, must be never, once or freely", value)
+	}
+	*r = renegotiation(value)
+	return nil
+}
+
+// renegotiationVerifier records a TLSRenegotiation stage for every handshake
+// but the first of a connection. Verification is the only hook that runs on a
+// renegotiation.
+func renegotiationVerifier(trace func() *BufferedClientTrace) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if t := trace(); t != nil && t.handshaked() {
+			t.add("TLSRenegotiation", map[string]interface{}{
+				"version":     tls.VersionName(state.Version),
+				"cipherSuite": tls.CipherSuiteName(state.CipherSuite),
+			})
+		}
+		return nil
+	}
+}
+
+// fingerprint is a SHA-256 fingerprint given in hex, with or without colons,
+// or in base64.
+type fingerprint []byte
+
+func (f *fingerprint) String() string {
+	return hex.EncodeToString(*f)
+}
+
+func (f *fingerprint) Set(value string) error {
+	if b, err := hex.DecodeString(strings.ReplaceAll(value, ":", "")); err == nil && len(b) == sha256.Size {
+		*f = b
+		return nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(value); err == nil && len(b) == sha256.Size {
+		*f = b
+		return nil
+	}
+	return fmt.Errorf("invalid SHA-256 fingerprint %q", value)
+}
+
+// pinVerifier fails the handshake when the SHA-256 of the leaf certificate
+// isn't pin.
+func pinVerifier(pin fingerprint, trace func() *BufferedClientTrace) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate to check the pin against")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if bytes.Equal(sum[:], pin) {
+			return nil
+		}
+
+		trace().add("CertificatePinMismatch", map[string]interface{}{
+			"expected": hex.EncodeToString(pin),
+			"actual":   hex.EncodeToString(sum[:]),
+		})
+		return fmt.Errorf("certificate pin mismatch: expected sha256 %x, got %x", []byte(pin), sum)
+	}
+}
+
+// maxCertSANs is how many subject alternative names a Certificate stage
+// lists, wildcard certificates of CDNs can have hundreds.
+const maxCertSANs = 10
+
+// certificateValues summarizes the certificate chain presented by the
+// server: validity, issuer, subject and the first SANs of the leaf, and the
+// subjects of the chain.
+func certificateValues(state tls.ConnectionState) map[string]interface{} {
+	leaf := state.PeerCertificates[0]
+
+	sans := append([]string(nil), leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	total := len(sans)
+	if total > maxCertSANs {
+		sans = sans[:maxCertSANs]
+	}
+	chain := make([]string, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		chain = append(chain, cert.Subject.String())
+	}
+
+	return map[string]interface{}{
+		"subject":   leaf.Subject.String(),
+		"issuer":    leaf.Issuer.String(),
+		"notBefore": leaf.NotBefore,
+		"notAfter":  leaf.NotAfter,
+		"expiresIn": time.Until(leaf.NotAfter).Round(time.Second).String(),
+		"sans":      sans,
+		"sansTotal": total,
+		"chain":     chain,
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+type Stage struct {
+	Name         string                 `json:"Name"`
+	Time         time.Time              `json:"Time"`
+	RelativeTime *float64               `json:"RelativeTime,omitempty"`
+	Values       map[string]interface{} `json:"Values"`
+	// Original is the name of a stage renamed by --stage-names, exported so
+	// compare finds the phases of the renamed stages.
+	Original string `json:"Original,omitempty"`
+}
+
+// setRelativeTimes sets the RelativeTime of the stages to the milliseconds
+// since the first one, the start of the request.
+func setRelativeTimes(stages []Stage) {
+	if len(stages) == 0 {
+		return
+	}
+	start := stages[0].Time
+	for i := range stages {
+		ms := float64(stages[i].Time.Sub(start)) / float64(time.Millisecond)
+		stages[i].RelativeTime = &ms
+	}
+}
+
+// canonicalStages sorts stages by time, since callbacks of different
+// goroutines can be collected slightly out of order. Unless verbose, the
+// WriteHeaderField stages are collapsed into one WriteHeaderFields stage, at
+// the time of the first, listing the keys written.
+func canonicalStages(stages []Stage, verbose bool) []Stage {
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stages[i].Time.Before(stages[j].Time)
+	})
+	if verbose {
+		return stages
+	}
+
+	canonical := make([]Stage, 0, len(stages))
+	summary := -1
+	for _, stage := range stages {
+		if stage.Name != "WriteHeaderField" {
+			canonical = append(canonical, stage)
+			continue
+		}
+		if summary < 0 {
+			summary = len(canonical)
+			canonical = append(canonical, Stage{
+				Name:   "WriteHeaderFields",
+				Time:   stage.Time,
+				Values: map[string]interface{}{"keys": []string{}},
+			})
+		}
+		values := canonical[summary].Values
+		values["keys"] = append(values["keys"].([]string), fmt.Sprint(stage.Values["key"]))
+		values["count"] = len(values["keys"].([]string))
+	}
+	return canonical
+}
+
+// BufferedClientTrace collects the stages of one request. The httptrace
+// callbacks fire from several goroutines, so they send the stages to a single
+// collector goroutine that owns the slice until Finish.
+type BufferedClientTrace struct {
+	httptrace.ClientTrace
+
+	mu       sync.RWMutex // guards closed against sends on a closed ch
+	closed   bool
+	ch       chan Stage
+	done     chan struct{}
+	stagesMu sync.Mutex // guards stages against snapshot while collecting
+	stages   []Stage
+	onStage  func(Stage)
+	hostPort string
+
+	// certificates adds a Certificate stage after every successful TLS
+	// handshake.
+	certificates bool
+
+	// goroutineIDs adds the goroutine that added every stage to its values.
+	goroutineIDs bool
+
+	// onAdd is called with the name of every stage as it's added, before it
+	// is collected, for what has to follow the request as it happens.
+	onAdd func(name string)
+
+	dnsStarted atomic.Bool
+	// dnsHost is the host of the lookup, set by DNSStart before DNSDone on
+	// the same goroutine.
+	dnsHost string
+	// warmDNS is set when the connection was dialed from the --warm-dns
+	// cache.
+	warmDNS atomic.Bool
+	// handshakes counts the TLS handshakes of the connection of the request,
+	// at least one once a reused connection was got.
+	handshakes atomic.Int32
+	// earlyData is set by the dials of --tls-early-data before
+	// TLSHandshakeDone, with whether the server accepted the early data.
+	earlyData         atomic.Bool
+	earlyDataAccepted atomic.Bool
+
+	// errno adds the errno of a failed connect to ConnectDone.
+	errno bool
+
+	// http2Conn is the state of the HTTP/2 connection the request got, as
+	// the request started on it, for GotConn.
+	http2Conn atomic.Pointer[http2.ClientConnState]
+
+	// httpsProxy is the host of the HTTPS proxy of the request, whose TLS
+	// handshake is recorded apart from the one with the origin inside the
+	// tunnel.
+	httpsProxy string
+	// proxyURL is the proxy of the request, tunneled through by
+	// --proxy-ntlm.
+	proxyURL *url.URL
+	// proxyConnected is set once the CONNECT of the proxy was answered.
+	proxyConnected atomic.Bool
+
+	// traceNameservers adds the nameservers of tracingResolver to DNSDone,
+	// and traceDNSQueries the number of queries and the CNAME chain.
+	traceNameservers bool
+	traceDNSQueries  bool
+	nsMu             sync.Mutex
+	nameservers      []nameserverDial
+	dnsQueries       int
+	cnames           map[string]string
+}
+
+func newStage(name string, values map[string]interface{}) Stage {
+	return Stage{
+		Name:   name,
+		Time:   time.Now(),
+		Values: values,
+	}
+}
+
+// dnsSkipReason explains why a connection was obtained without a DNS lookup,
+// so the gap in the timeline isn't mistaken for a DNS failure.
+func dnsSkipReason(hostPort string, info httptrace.GotConnInfo) string {
+	if info.Reused {
+		return "reused connection"
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	if net.ParseIP(host) != nil {
+		return "IP literal"
+	}
+	return "unknown"
+}
+
+// goroutineID returns the ID of the current goroutine, parsed from the
+// header of its stack trace since the runtime doesn't expose it otherwise.
+// It costs a stack trace, so it's only for debugging.
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// goroutine 123 [running]:
+	field, _, _ := bytes.Cut(bytes.TrimPrefix(buf, []byte("goroutine ")), []byte(" "))
+	id, _ := strconv.ParseInt(string(field), 10, 64)
+	return id
+}
+
+// errString is the message of err, or "" when there was no error. Errors
+// marshal to {} in JSON, so stages that carry one record this instead.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+type traceContextKey struct{}
+
+// withBufferedClientTrace installs trace as the httptrace of ctx and keeps it
+// reachable for hooks that only get the request.
+func withBufferedClientTrace(ctx context.Context, trace *BufferedClientTrace) context.Context {
+	ctx = context.WithValue(ctx, traceContextKey{}, trace)
+	return httptrace.WithClientTrace(ctx, &trace.ClientTrace)
+}
+
+func bufferedClientTraceFrom(ctx context.Context) *BufferedClientTrace {
+	trace, _ := ctx.Value(traceContextKey{}).(*BufferedClientTrace)
+	return trace
+}
+
+func (t *BufferedClientTrace) addNameserver(dial nameserverDial) {
+	t.nsMu.Lock()
+	defer t.nsMu.Unlock()
+	t.nameservers = append(t.nameservers, dial)
+}
+
+// nameserverValues are the nameservers dialed so far and the one that
+// answered, "unknown" when none was dialed: the answer came from the hosts
+// file or the resolver wasn't used.
+func (t *BufferedClientTrace) nameserverValues(values map[string]interface{}, err error) {
+	t.nsMu.Lock()
+	defer t.nsMu.Unlock()
+	values["nameserverDials"] = append([]nameserverDial(nil), t.nameservers...)
+	switch {
+	case len(t.nameservers) == 0:
+		values["nameserver"] = "unknown"
+	case err == nil:
+		values["nameserver"] = t.nameservers[len(t.nameservers)-1].Addr
+	default:
+		values["nameserver"] = ""
+	}
+}
+
+// dnsQueryValues are the queries sent so far and the CNAME chain from host,
+// "unknown" when no query went through tracingResolver: the answer came from
+// the hosts file or the resolver of the system, opaque to the trace.
+func (t *BufferedClientTrace) dnsQueryValues(values map[string]interface{}, host string) {
+	t.nsMu.Lock()
+	defer t.nsMu.Unlock()
+	if t.dnsQueries == 0 {
+		values["queries"] = "unknown"
+		return
+	}
+	values["queries"] = t.dnsQueries
+	if chain := cnameChain(host, t.cnames); chain != nil {
+		values["cnameChain"] = chain
+		values["cnameHops"] = len(chain) - 1
+	}
+}
+
+// handshaked reports whether the connection of the request already did a TLS
+// handshake, so a new one is a renegotiation.
+func (t *BufferedClientTrace) handshaked() bool {
+	return t.handshakes.Load() > 0
+}
+
+// add records a stage. Stages added after Finish are dropped.
+func (t *BufferedClientTrace) add(name string, values map[string]interface{}) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !t.closed {
+		if t.goroutineIDs {
+			if values == nil {
+				values = map[string]interface{}{}
+			}
+			values["goroutine"] = goroutineID()
+		}
+		if t.onAdd != nil {
+			t.onAdd(name)
+		}
+		t.ch <- newStage(name, values)
+	}
+}
+
+func (t *BufferedClientTrace) collect() {
+	defer close(t.done)
+	for stage := range t.ch {
+		t.stagesMu.Lock()
+		t.stages = append(t.stages, stage)
+		t.stagesMu.Unlock()
+		if t.onStage != nil {
+			t.onStage(stage)
+		}
+	}
+}
+
+// Finish stops collecting and returns the stages once all of them are
+// drained. It can be called more than once.
+func (t *BufferedClientTrace) Finish() []Stage {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.ch)
+	}
+	t.mu.Unlock()
+
+	<-t.done
+	return t.stages
+}
+
+// tlsLeg tells which TLS handshake is going on through an HTTPS proxy: the
+// one with the proxy before CONNECT, the one with the origin in the tunnel
+// after. It's "" without an HTTPS proxy.
+func (t *BufferedClientTrace) tlsLeg() string {
+	switch {
+	case t.httpsProxy == "":
+		return ""
+	case t.proxyConnected.Load():
+		return "origin"
+	}
+	return "proxy"
+}
+
+// snapshot returns the stages collected so far, while the request is still
+// going on.
+func (t *BufferedClientTrace) snapshot() []Stage {
+	t.stagesMu.Lock()
+	defer t.stagesMu.Unlock()
+	return append([]Stage(nil), t.stages...)
+}
+
+// NewBufferedClientTrace starts collecting stages. onStage, if not nil, is
+// called from the collector goroutine for every stage in order.
+func NewBufferedClientTrace(onStage func(Stage)) *BufferedClientTrace {
+	trace := &BufferedClientTrace{
+		ch:      make(chan Stage, 64),
+		done:    make(chan struct{}),
+		stages:  make([]Stage, 0, 16),
+		onStage: onStage,
+	}
+	go trace.collect()
+
+	trace.ClientTrace = httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			trace.hostPort = hostPort
+			trace.add("GetConn", map[string]interface{}{
+				"hostPort": hostPort,
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				trace.handshakes.Add(1)
+			}
+			values := map[string]interface{}{
+				"GotConnInfo": info,
+				"reused":      info.Reused,
+				"wasIdle":     info.WasIdle,
+				"idleTime":    info.IdleTime.String(),
+			}
+			// Only HTTP/2 connections have streams.
+			if state := trace.http2Conn.Load(); state != nil {
+				values["streamsActive"] = state.StreamsActive
+				values["maxConcurrentStreams"] = state.MaxConcurrentStreams
+			}
+			trace.add("GotConn", values)
+			if !trace.dnsStarted.Load() {
+				reason := dnsSkipReason(trace.hostPort, info)
+				if trace.warmDNS.Load() && !info.Reused {
+					reason = "warm DNS cache"
+				}
+				trace.add("DNSSkipped", map[string]interface{}{
+					"reason": reason,
+				})
+			}
+		},
+		PutIdleConn: func(err error) {
+			trace.add("PutIdleConn", map[string]interface{}{
+				"err": fmt.Sprintf("%v", err),
+			})
+		},
+		GotFirstResponseByte: func() {
+			trace.add("GotFirstResponseByte", map[string]interface{}{})
+		},
+		Got100Continue: func() {
+			trace.add("Got100Continue", map[string]interface{}{})
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			trace.add("Got1xxResponse", map[string]interface{}{
+				"code":   code,
+				"header": header,
+			})
+			return nil
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			trace.dnsStarted.Store(true)
+			trace.dnsHost = info.Host
+			trace.add("DNSStart", map[string]interface{}{
+				"DNSStartInfo": info,
+			})
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			values := map[string]interface{}{
+				"DNSDoneInfo": info,
+			}
+			if trace.traceNameservers {
+				trace.nameserverValues(values, info.Err)
+			}
+			if trace.traceDNSQueries {
+				trace.dnsQueryValues(values, trace.dnsHost)
+			}
+			trace.add("DNSDone", values)
+		},
+		ConnectStart: func(network, addr string) {
+			trace.add("ConnectStart", map[string]interface{}{
+				"network": network,
+				"addr":    addr,
+			})
+		},
+		ConnectDone: func(network, addr string, err error) {
+			var netErr net.Error
+			values := map[string]interface{}{
+				"network": network,
+				"addr":    addr,
+				"error":   err,
+				"timeout": errors.As(err, &netErr) && netErr.Timeout(),
+			}
+			if trace.errno {
+				addErrno(values, err)
+			}
+			trace.add("ConnectDone", values)
+		},
+		TLSHandshakeStart: func() {
+			switch leg := trace.tlsLeg(); leg {
+			case "proxy":
+				trace.add("ProxyTLSHandshakeStart", map[string]interface{}{
+					"leg":   leg,
+					"proxy": trace.httpsProxy,
+				})
+			case "origin":
+				trace.add("TLSHandshakeStart", map[string]interface{}{
+					"leg": leg,
+				})
+			default:
+				trace.add("TLSHandshakeStart", map[string]interface{}{})
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			leg := trace.tlsLeg()
+			if leg == "proxy" {
+				values := serverNameValues(state, err)
+				values["leg"] = leg
+				values["proxy"] = trace.httpsProxy
+				values["error"] = err
+				if err != nil {
+					values["tlsError"] = err.Error()
+				}
+				trace.add("ProxyTLSHandshakeDone", values)
+				return
+			}
+			trace.handshakes.Add(1)
+			values := serverNameValues(state, err)
+			if leg != "" {
+				values["leg"] = leg
+			}
+			values["didResume"] = state.DidResume
+			if trace.earlyData.Load() {
+				values["earlyDataAccepted"] = trace.earlyDataAccepted.Load()
+			}
+			values["state"] = state
+			values["error"] = err
+			if err != nil {
+				values["tlsError"] = err.Error()
+				// Whatever was negotiated before the handshake failed.
+				if state.Version != 0 {
+					values["version"] = tls.VersionName(state.Version)
+				}
+				if state.CipherSuite != 0 {
+					values["cipherSuite"] = tls.CipherSuiteName(state.CipherSuite)
+				}
+			}
+			trace.add("TLSHandshakeDone", values)
+			if trace.certificates && err == nil && len(state.PeerCertificates) > 0 {
+				trace.add("Certificate", certificateValues(state))
+			}
+		},
+		WroteHeaderField: func(key string, value []string) {
+			trace.add("WriteHeaderField", map[string]interface{}{
+				"key":   key,
+				"value": redactHeader(key, value),
+			})
+		},
+		WroteHeaders: func() {
+			trace.add("WriteHeaders", map[string]interface{}{})
+		},
+		Wait100Continue: func() {
+			trace.add("Wait100Continue", map[string]interface{}{})
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			trace.add("WroteRequest", map[string]interface{}{
+				"WroteRequestInfo": info,
+				"err":              errString(info.Err),
+			})
+		},
+	}
+
+	return trace
+}
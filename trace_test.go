@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestBufferedClientTraceConcurrent adds stages from many goroutines while
+// others take snapshots, as the httptrace callbacks and --progress do, and
+// checks under -race that Finish returns every stage added before it.
+func TestBufferedClientTraceConcurrent(t *testing.T) {
+	const goroutines, perGoroutine = 16, 100
+
+	var onStage int
+	trace := NewBufferedClientTrace(func(Stage) { onStage++ })
+	var adders, snapshotters sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		snapshotters.Add(1)
+		go func() {
+			defer snapshotters.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					trace.snapshot()
+				}
+			}
+		}()
+	}
+	for g := 0; g < goroutines; g++ {
+		adders.Add(1)
+		go func(g int) {
+			defer adders.Done()
+			for i := 0; i < perGoroutine; i++ {
+				trace.add(fmt.Sprintf("%d-%d", g, i), nil)
+			}
+		}(g)
+	}
+	adders.Wait()
+	stages := trace.Finish()
+	close(stop)
+	snapshotters.Wait()
+
+	if len(stages) != goroutines*perGoroutine {
+		t.Fatalf("Finish returned %d stages, want %d", len(stages), goroutines*perGoroutine)
+	}
+	if onStage != len(stages) {
+		t.Errorf("onStage called %d times, want %d", onStage, len(stages))
+	}
+	seen := map[string]bool{}
+	for _, stage := range stages {
+		if seen[stage.Name] {
+			t.Errorf("stage %s collected twice", stage.Name)
+		}
+		seen[stage.Name] = true
+	}
+	// Per goroutine, the stages are collected in the order they were added.
+	next := make([]int, goroutines)
+	for _, stage := range stages {
+		var g, i int
+		if _, err := fmt.Sscanf(stage.Name, "%d-%d", &g, &i); err != nil {
+			t.Fatalf("stage %q: %v", stage.Name, err)
+		}
+		if i != next[g] {
+			t.Fatalf("stage %s collected after %d-%d", stage.Name, g, next[g]-1)
+		}
+		next[g]++
+	}
+	if got := trace.snapshot(); len(got) != len(stages) {
+		t.Errorf("snapshot after Finish has %d stages, want %d", len(got), len(stages))
+	}
+}
+
+// TestBufferedClientTraceFinishDuringAdd calls Finish while stages are still
+// being added, as when a request is canceled with callbacks in flight: the
+// late adds are dropped rather than sent on the closed channel, which would
+// panic.
+func TestBufferedClientTraceFinishDuringAdd(t *testing.T) {
+	const goroutines, perGoroutine = 16, 100
+
+	trace := NewBufferedClientTrace(nil)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < perGoroutine; i++ {
+				trace.add(fmt.Sprintf("%d-%d", g, i), nil)
+				trace.snapshot()
+			}
+		}(g)
+	}
+	var finished [][]Stage
+	var finishMu sync.Mutex
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			stages := trace.Finish()
+			finishMu.Lock()
+			finished = append(finished, stages)
+			finishMu.Unlock()
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	stages := trace.Finish()
+	if len(stages) > goroutines*perGoroutine {
+		t.Fatalf("Finish returned %d stages, more than the %d added", len(stages), goroutines*perGoroutine)
+	}
+	for _, other := range finished {
+		if len(other) != len(stages) {
+			t.Errorf("Finish returned %d stages, then %d", len(other), len(stages))
+		}
+	}
+	trace.add("late", nil)
+	if got := trace.Finish(); len(got) != len(stages) {
+		t.Errorf("add after Finish collected a stage: %d, want %d", len(got), len(stages))
+	}
+}
+
+// failingBody fails the write of the request body after its first read.
+type failingBody struct{ read bool }
+
+var errBodyRead = errors.New("body read failed")
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.read {
+		return 0, errBodyRead
+	}
+	b.read = true
+	return copy(p, "partial"), nil
+}
+
+// TestWroteRequestError fails the write of the request body and checks its
+// error is recorded as a string in the WroteRequest stage, which is
+// exported as is.
+func TestWroteRequestError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	trace := NewBufferedClientTrace(nil)
+	ctx := withBufferedClientTrace(context.Background(), trace)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, &failingBody{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = 100
+	resp, err := server.Client().Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request succeeded, want the error of the body")
+	}
+	stages := trace.Finish()
+
+	var wrote *Stage
+	for i := range stages {
+		if stages[i].Name == "WroteRequest" {
+			wrote = &stages[i]
+		}
+	}
+	if wrote == nil {
+		t.Fatalf("no WroteRequest stage in %v", stages)
+	}
+	got, ok := wrote.Values["err"].(string)
+	if !ok || !strings.Contains(got, errBodyRead.Error()) {
+		t.Errorf("WroteRequest err = %#v, want a string with %q", wrote.Values["err"], errBodyRead)
+	}
+
+	b, err := json.Marshal(wrote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), errBodyRead.Error()) {
+		t.Errorf("exported WroteRequest %s doesn't have the error", b)
+	}
+}
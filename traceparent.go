@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// traceID is a W3C trace ID given on the command line, 32 hex digits.
+type traceID string
+
+func (t *traceID) String() string {
+	return string(*t)
+}
+
+func (t *traceID) Set(value string) error {
+	value = strings.ToLower(value)
+	if b, err := hex.DecodeString(value); err != nil || len(b) != 16 || value == strings.Repeat("0", 32) {
+		return fmt.Errorf("invalid trace ID %q, must be 32 hex digits and not all zero", value)
+	}
+	*t = traceID(value)
+	return nil
+}
+
+// traceparent returns a W3C traceparent header of a new sampled span of the
+// trace, or of a new trace when id is empty, with the IDs it used.
+func traceparent(id traceID) (header, traceIDHex, spanIDHex string) {
+	traceIDHex = string(id)
+	if traceIDHex == "" {
+		traceIDHex = randomHex(16)
+	}
+	spanIDHex = randomHex(8)
+	return "00-" + traceIDHex + "-" + spanIDHex + "-01", traceIDHex, spanIDHex
+}
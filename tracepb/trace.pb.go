@@ -0,0 +1,613 @@
+// Schema of the protobuf output format: a file of Result messages, each
+// prefixed with its length as a varint, as written by writeDelimitedTo of
+// the protobuf libraries. trace.pb.go is generated from it with
+// protoc-gen-go, see the go:generate line of protobuf.go.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: trace.proto
+
+package tracepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Result is a request, the same as a line of the ndjson output format.
+type Result struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SchemaVersion uint32                 `protobuf:"varint,1,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	RunId         string                 `protobuf:"bytes,2,opt,name=run_id,json=runId,proto3" json:"run_id,omitempty"`
+	Method        string                 `protobuf:"bytes,3,opt,name=method,proto3" json:"method,omitempty"`
+	Url           string                 `protobuf:"bytes,4,opt,name=url,proto3" json:"url,omitempty"`
+	StartUnixNano int64                  `protobuf:"varint,5,opt,name=start_unix_nano,json=startUnixNano,proto3" json:"start_unix_nano,omitempty"`
+	Status        int32                  `protobuf:"varint,6,opt,name=status,proto3" json:"status,omitempty"`
+	Proto         string                 `protobuf:"bytes,7,opt,name=proto,proto3" json:"proto,omitempty"`
+	Error         string                 `protobuf:"bytes,8,opt,name=error,proto3" json:"error,omitempty"`
+	ErrorCategory string                 `protobuf:"bytes,9,opt,name=error_category,json=errorCategory,proto3" json:"error_category,omitempty"`
+	RemoteAddr    string                 `protobuf:"bytes,10,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	// The phases, such as dns, connect, tls, ttfb and total, in nanoseconds.
+	DurationsNs map[string]int64 `protobuf:"bytes,11,rep,name=durations_ns,json=durationsNs,proto3" json:"durations_ns,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Stages      []*Stage         `protobuf:"bytes,12,rep,name=stages,proto3" json:"stages,omitempty"`
+	// The failed attempts before this one with --retries-per-iteration.
+	Attempts      []*Result `protobuf:"bytes,13,rep,name=attempts,proto3" json:"attempts,omitempty"`
+	SessionId     string    `protobuf:"bytes,14,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Step          int32     `protobuf:"varint,15,opt,name=step,proto3" json:"step,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Result) Reset() {
+	*x = Result{}
+	mi := &file_trace_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Result) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Result) ProtoMessage() {}
+
+func (x *Result) ProtoReflect() protoreflect.Message {
+	mi := &file_trace_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Result.ProtoReflect.Descriptor instead.
+func (*Result) Descriptor() ([]byte, []int) {
+	return file_trace_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Result) GetSchemaVersion() uint32 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *Result) GetRunId() string {
+	if x != nil {
+		return x.RunId
+	}
+	return ""
+}
+
+func (x *Result) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *Result) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *Result) GetStartUnixNano() int64 {
+	if x != nil {
+		return x.StartUnixNano
+	}
+	return 0
+}
+
+func (x *Result) GetStatus() int32 {
+	if x != nil {
+		return x.Status
+	}
+	return 0
+}
+
+func (x *Result) GetProto() string {
+	if x != nil {
+		return x.Proto
+	}
+	return ""
+}
+
+func (x *Result) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Result) GetErrorCategory() string {
+	if x != nil {
+		return x.ErrorCategory
+	}
+	return ""
+}
+
+func (x *Result) GetRemoteAddr() string {
+	if x != nil {
+		return x.RemoteAddr
+	}
+	return ""
+}
+
+func (x *Result) GetDurationsNs() map[string]int64 {
+	if x != nil {
+		return x.DurationsNs
+	}
+	return nil
+}
+
+func (x *Result) GetStages() []*Stage {
+	if x != nil {
+		return x.Stages
+	}
+	return nil
+}
+
+func (x *Result) GetAttempts() []*Result {
+	if x != nil {
+		return x.Attempts
+	}
+	return nil
+}
+
+func (x *Result) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *Result) GetStep() int32 {
+	if x != nil {
+		return x.Step
+	}
+	return 0
+}
+
+// Stage is a stage of the timeline of a request.
+type Stage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Nanoseconds since the start of the request, smaller than a timestamp.
+	OffsetNs int64 `protobuf:"varint,2,opt,name=offset_ns,json=offsetNs,proto3" json:"offset_ns,omitempty"`
+	// The values of the stage, which differ from a stage to the other. A TLS
+	// connection state has the SHA-256 of the peer certificates rather than
+	// the certificates.
+	Values        map[string]*Value `protobuf:"bytes,4,rep,name=values,proto3" json:"values,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Stage) Reset() {
+	*x = Stage{}
+	mi := &file_trace_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stage) ProtoMessage() {}
+
+func (x *Stage) ProtoReflect() protoreflect.Message {
+	mi := &file_trace_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stage.ProtoReflect.Descriptor instead.
+func (*Stage) Descriptor() ([]byte, []int) {
+	return file_trace_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Stage) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Stage) GetOffsetNs() int64 {
+	if x != nil {
+		return x.OffsetNs
+	}
+	return 0
+}
+
+func (x *Stage) GetValues() map[string]*Value {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+// Value is a value of a stage, as it is in JSON. A null is a Value without
+// a kind.
+type Value struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Kind:
+	//
+	//	*Value_StringValue
+	//	*Value_IntValue
+	//	*Value_DoubleValue
+	//	*Value_BoolValue
+	//	*Value_ListValue
+	//	*Value_MapValue
+	Kind          isValue_Kind `protobuf_oneof:"kind"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Value) Reset() {
+	*x = Value{}
+	mi := &file_trace_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Value) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Value) ProtoMessage() {}
+
+func (x *Value) ProtoReflect() protoreflect.Message {
+	mi := &file_trace_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Value.ProtoReflect.Descriptor instead.
+func (*Value) Descriptor() ([]byte, []int) {
+	return file_trace_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Value) GetKind() isValue_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return nil
+}
+
+func (x *Value) GetStringValue() string {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_StringValue); ok {
+			return x.StringValue
+		}
+	}
+	return ""
+}
+
+func (x *Value) GetIntValue() int64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_IntValue); ok {
+			return x.IntValue
+		}
+	}
+	return 0
+}
+
+func (x *Value) GetDoubleValue() float64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_DoubleValue); ok {
+			return x.DoubleValue
+		}
+	}
+	return 0
+}
+
+func (x *Value) GetBoolValue() bool {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_BoolValue); ok {
+			return x.BoolValue
+		}
+	}
+	return false
+}
+
+func (x *Value) GetListValue() *ValueList {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_ListValue); ok {
+			return x.ListValue
+		}
+	}
+	return nil
+}
+
+func (x *Value) GetMapValue() *ValueMap {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_MapValue); ok {
+			return x.MapValue
+		}
+	}
+	return nil
+}
+
+type isValue_Kind interface {
+	isValue_Kind()
+}
+
+type Value_StringValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3,oneof"`
+}
+
+type Value_IntValue struct {
+	// Whole numbers, the most common, as varints.
+	IntValue int64 `protobuf:"zigzag64,2,opt,name=int_value,json=intValue,proto3,oneof"`
+}
+
+type Value_DoubleValue struct {
+	DoubleValue float64 `protobuf:"fixed64,3,opt,name=double_value,json=doubleValue,proto3,oneof"`
+}
+
+type Value_BoolValue struct {
+	BoolValue bool `protobuf:"varint,4,opt,name=bool_value,json=boolValue,proto3,oneof"`
+}
+
+type Value_ListValue struct {
+	ListValue *ValueList `protobuf:"bytes,5,opt,name=list_value,json=listValue,proto3,oneof"`
+}
+
+type Value_MapValue struct {
+	MapValue *ValueMap `protobuf:"bytes,6,opt,name=map_value,json=mapValue,proto3,oneof"`
+}
+
+func (*Value_StringValue) isValue_Kind() {}
+
+func (*Value_IntValue) isValue_Kind() {}
+
+func (*Value_DoubleValue) isValue_Kind() {}
+
+func (*Value_BoolValue) isValue_Kind() {}
+
+func (*Value_ListValue) isValue_Kind() {}
+
+func (*Value_MapValue) isValue_Kind() {}
+
+type ValueList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Values        []*Value               `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ValueList) Reset() {
+	*x = ValueList{}
+	mi := &file_trace_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ValueList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValueList) ProtoMessage() {}
+
+func (x *ValueList) ProtoReflect() protoreflect.Message {
+	mi := &file_trace_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValueList.ProtoReflect.Descriptor instead.
+func (*ValueList) Descriptor() ([]byte, []int) {
+	return file_trace_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ValueList) GetValues() []*Value {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+type ValueMap struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Fields        map[string]*Value      `protobuf:"bytes,1,rep,name=fields,proto3" json:"fields,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ValueMap) Reset() {
+	*x = ValueMap{}
+	mi := &file_trace_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ValueMap) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValueMap) ProtoMessage() {}
+
+func (x *ValueMap) ProtoReflect() protoreflect.Message {
+	mi := &file_trace_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValueMap.ProtoReflect.Descriptor instead.
+func (*ValueMap) Descriptor() ([]byte, []int) {
+	return file_trace_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ValueMap) GetFields() map[string]*Value {
+	if x != nil {
+		return x.Fields
+	}
+	return nil
+}
+
+var File_trace_proto protoreflect.FileDescriptor
+
+const file_trace_proto_rawDesc = "" +
+	"\n" +
+	"\vtrace.proto\x12\vdumppcap.v1\"\xbd\x04\n" +
+	"\x06Result\x12%\n" +
+	"\x0eschema_version\x18\x01 \x01(\rR\rschemaVersion\x12\x15\n" +
+	"\x06run_id\x18\x02 \x01(\tR\x05runId\x12\x16\n" +
+	"\x06method\x18\x03 \x01(\tR\x06method\x12\x10\n" +
+	"\x03url\x18\x04 \x01(\tR\x03url\x12&\n" +
+	"\x0fstart_unix_nano\x18\x05 \x01(\x03R\rstartUnixNano\x12\x16\n" +
+	"\x06status\x18\x06 \x01(\x05R\x06status\x12\x14\n" +
+	"\x05proto\x18\a \x01(\tR\x05proto\x12\x14\n" +
+	"\x05error\x18\b \x01(\tR\x05error\x12%\n" +
+	"\x0eerror_category\x18\t \x01(\tR\rerrorCategory\x12\x1f\n" +
+	"\vremote_addr\x18\n" +
+	" \x01(\tR\n" +
+	"remoteAddr\x12G\n" +
+	"\fdurations_ns\x18\v \x03(\v2$.dumppcap.v1.Result.DurationsNsEntryR\vdurationsNs\x12*\n" +
+	"\x06stages\x18\f \x03(\v2\x12.dumppcap.v1.StageR\x06stages\x12/\n" +
+	"\battempts\x18\r \x03(\v2\x13.dumppcap.v1.ResultR\battempts\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x0e \x01(\tR\tsessionId\x12\x12\n" +
+	"\x04step\x18\x0f \x01(\x05R\x04step\x1a>\n" +
+	"\x10DurationsNsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x01\"\xd2\x01\n" +
+	"\x05Stage\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1b\n" +
+	"\toffset_ns\x18\x02 \x01(\x03R\boffsetNs\x126\n" +
+	"\x06values\x18\x04 \x03(\v2\x1e.dumppcap.v1.Stage.ValuesEntryR\x06values\x1aM\n" +
+	"\vValuesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12(\n" +
+	"\x05value\x18\x02 \x01(\v2\x12.dumppcap.v1.ValueR\x05value:\x028\x01J\x04\b\x03\x10\x04R\vvalues_json\"\x88\x02\n" +
+	"\x05Value\x12#\n" +
+	"\fstring_value\x18\x01 \x01(\tH\x00R\vstringValue\x12\x1d\n" +
+	"\tint_value\x18\x02 \x01(\x12H\x00R\bintValue\x12#\n" +
+	"\fdouble_value\x18\x03 \x01(\x01H\x00R\vdoubleValue\x12\x1f\n" +
+	"\n" +
+	"bool_value\x18\x04 \x01(\bH\x00R\tboolValue\x127\n" +
+	"\n" +
+	"list_value\x18\x05 \x01(\v2\x16.dumppcap.v1.ValueListH\x00R\tlistValue\x124\n" +
+	"\tmap_value\x18\x06 \x01(\v2\x15.dumppcap.v1.ValueMapH\x00R\bmapValueB\x06\n" +
+	"\x04kind\"7\n" +
+	"\tValueList\x12*\n" +
+	"\x06values\x18\x01 \x03(\v2\x12.dumppcap.v1.ValueR\x06values\"\x94\x01\n" +
+	"\bValueMap\x129\n" +
+	"\x06fields\x18\x01 \x03(\v2!.dumppcap.v1.ValueMap.FieldsEntryR\x06fields\x1aM\n" +
+	"\vFieldsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12(\n" +
+	"\x05value\x18\x02 \x01(\v2\x12.dumppcap.v1.ValueR\x05value:\x028\x01B\x0eZ\fpcap/tracepbb\x06proto3"
+
+var (
+	file_trace_proto_rawDescOnce sync.Once
+	file_trace_proto_rawDescData []byte
+)
+
+func file_trace_proto_rawDescGZIP() []byte {
+	file_trace_proto_rawDescOnce.Do(func() {
+		file_trace_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_trace_proto_rawDesc), len(file_trace_proto_rawDesc)))
+	})
+	return file_trace_proto_rawDescData
+}
+
+var file_trace_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_trace_proto_goTypes = []any{
+	(*Result)(nil),    // 0: dumppcap.v1.Result
+	(*Stage)(nil),     // 1: dumppcap.v1.Stage
+	(*Value)(nil),     // 2: dumppcap.v1.Value
+	(*ValueList)(nil), // 3: dumppcap.v1.ValueList
+	(*ValueMap)(nil),  // 4: dumppcap.v1.ValueMap
+	nil,               // 5: dumppcap.v1.Result.DurationsNsEntry
+	nil,               // 6: dumppcap.v1.Stage.ValuesEntry
+	nil,               // 7: dumppcap.v1.ValueMap.FieldsEntry
+}
+var file_trace_proto_depIdxs = []int32{
+	5,  // 0: dumppcap.v1.Result.durations_ns:type_name -> dumppcap.v1.Result.DurationsNsEntry
+	1,  // 1: dumppcap.v1.Result.stages:type_name -> dumppcap.v1.Stage
+	0,  // 2: dumppcap.v1.Result.attempts:type_name -> dumppcap.v1.Result
+	6,  // 3: dumppcap.v1.Stage.values:type_name -> dumppcap.v1.Stage.ValuesEntry
+	3,  // 4: dumppcap.v1.Value.list_value:type_name -> dumppcap.v1.ValueList
+	4,  // 5: dumppcap.v1.Value.map_value:type_name -> dumppcap.v1.ValueMap
+	2,  // 6: dumppcap.v1.ValueList.values:type_name -> dumppcap.v1.Value
+	7,  // 7: dumppcap.v1.ValueMap.fields:type_name -> dumppcap.v1.ValueMap.FieldsEntry
+	2,  // 8: dumppcap.v1.Stage.ValuesEntry.value:type_name -> dumppcap.v1.Value
+	2,  // 9: dumppcap.v1.ValueMap.FieldsEntry.value:type_name -> dumppcap.v1.Value
+	10, // [10:10] is the sub-list for method output_type
+	10, // [10:10] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_trace_proto_init() }
+func file_trace_proto_init() {
+	if File_trace_proto != nil {
+		return
+	}
+	file_trace_proto_msgTypes[2].OneofWrappers = []any{
+		(*Value_StringValue)(nil),
+		(*Value_IntValue)(nil),
+		(*Value_DoubleValue)(nil),
+		(*Value_BoolValue)(nil),
+		(*Value_ListValue)(nil),
+		(*Value_MapValue)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_trace_proto_rawDesc), len(file_trace_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_trace_proto_goTypes,
+		DependencyIndexes: file_trace_proto_depIdxs,
+		MessageInfos:      file_trace_proto_msgTypes,
+	}.Build()
+	File_trace_proto = out.File
+	file_trace_proto_goTypes = nil
+	file_trace_proto_depIdxs = nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// verboseStage returns the --verbose printer of the stages of one request,
+// or nil when it is off. It is called by the collector goroutine, so stages
+// are printed one at a time and in order. The stage that ends a phase is
+// followed by the duration of the phase, compared with the one of the
+// previous request.
+func (r *Runner) verboseStage() func(Stage) {
+	if !r.cfg.Verbose || r.cfg.Quiet {
+		return nil
+	}
+
+	// finish sets the durations of the previous request once its trace is
+	// finished, before the next request starts.
+	previous := r.verboseDurations
+	var stages []Stage
+	seen := make(map[string]bool)
+	return func(stage Stage) {
+		stages = append(stages, stage)
+		offset := stage.Time.Sub(stages[0].Time)
+		line := fmt.Sprintf("  %10s %s", "+"+offset.Round(time.Microsecond).String(), stage.Name)
+		// A phase ends at the first stage of its name.
+		if !seen[stage.Name] {
+			seen[stage.Name] = true
+			for _, phase := range phases {
+				if phase.End != stage.Name {
+					continue
+				}
+				if d, ok := phaseDurations(stages)[phase.Name]; ok {
+					line += " " + verbosePhase(phase.Name, d, previous)
+				}
+			}
+		}
+		fmt.Println(line)
+	}
+}
+
+// verboseTotal prints the total duration of a request once it's done, as
+// --verbose prints its phases, and keeps its durations to compare the next
+// request with.
+func (r *Runner) verboseTotal(durations map[string]time.Duration) {
+	if !r.cfg.Verbose || r.cfg.Quiet {
+		return
+	}
+	if d, ok := durations["total"]; ok {
+		fmt.Printf("  %10s %s\n", "", verbosePhase("total", d, r.verboseDurations))
+	}
+	r.verboseDurations = durations
+}
+
+// verbosePhase formats the duration of a phase and how much longer or
+// shorter it took than in previous, e.g. tls=20ms (+5ms).
+func verbosePhase(name string, d time.Duration, previous map[string]time.Duration) string {
+	s := fmt.Sprintf("%s=%s", name, d.Round(time.Microsecond))
+	if prev, ok := previous[name]; ok {
+		s += fmt.Sprintf(" (%s)", signedDuration(d-prev))
+	}
+	return s
+}
+
+// signedDuration formats d with its sign, e.g. +200ms or -3ms.
+func signedDuration(d time.Duration) string {
+	d = d.Round(time.Microsecond)
+	if d < 0 {
+		return d.String()
+	}
+	return "+" + d.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type watchdogError struct {
+	timeout time.Duration
+}
+
+func (e *watchdogError) Error() string {
+	return fmt.Sprintf("watchdog fired after %s", e.timeout)
+}
+
+// watchdogFlushTimeout is how long the loop has to close the capture and
+// the exporters once it gave up on a stuck request, before the program exits
+// anyway.
+const watchdogFlushTimeout = 30 * time.Second
+
+// watchdog is --watchdog-timeout, the last resort against a request stuck
+// despite every other timeout, such as in a dialer that ignores its context.
+// Once the request ran for timeout, it logs the stages it got through, adds
+// a WatchdogFired stage and cancels it. A request still stuck as long again
+// doesn't honor the cancellation: the watchdog abandons the run, for the
+// loop to leave the request behind and exit, rather than wedge forever.
+type watchdog struct {
+	fire *time.Timer
+	done chan struct{}
+}
+
+func startWatchdog(logger *logrus.Logger, trace *BufferedClientTrace, timeout time.Duration, cancel, abandon context.CancelCauseFunc) *watchdog {
+	w := &watchdog{done: make(chan struct{})}
+	w.fire = time.AfterFunc(timeout, func() {
+		stages := trace.snapshot()
+		last := ""
+		if len(stages) > 0 {
+			last = stages[len(stages)-1].Name
+		}
+		logger.WithFields(logrus.Fields{
+			"timeout":   timeout.String(),
+			"lastStage": last,
+			"stages":    stages,
+		}).Error("Watchdog fired, canceling the stuck request")
+		trace.add("WatchdogFired", map[string]interface{}{
+			"timeout":   timeout.String(),
+			"lastStage": last,
+		})
+		cancel(&watchdogError{timeout: timeout})
+
+		time.AfterFunc(timeout, func() {
+			select {
+			case <-w.done:
+				return
+			default:
+			}
+			logger.WithField("timeout", timeout.String()).Error("Request still stuck after the watchdog canceled it, abandoning the run")
+			abandon(&watchdogError{timeout: timeout})
+		})
+	})
+	return w
+}
+
+// stop disarms the watchdog once the request is done.
+func (w *watchdog) stop() {
+	w.fire.Stop()
+	close(w.done)
+}